@@ -0,0 +1,196 @@
+package accesslog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareFormats(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "hello")
+	})
+
+	req := httptest.NewRequest("POST", "/articles?x=1", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.Header.Set("Referer", "http://example.com/")
+	req.Header.Set("User-Agent", "test-agent")
+	req.SetBasicAuth("alice", "secret")
+
+	var combined bytes.Buffer
+	Middleware(&combined, Combined, handler).ServeHTTP(httptest.NewRecorder(), req)
+	line := combined.String()
+	for _, want := range []string{`10.0.0.1 - alice [`, `] "POST /articles?x=1 HTTP/1.1" 201 5 "http://example.com/" "test-agent"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("combined line %q does not contain %q", line, want)
+		}
+	}
+
+	var jsonl bytes.Buffer
+	Middleware(&jsonl, JSON, handler).ServeHTTP(httptest.NewRecorder(), req)
+	var entry map[string]interface{}
+	if err := json.Unmarshal(jsonl.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON line %q: %v", jsonl.String(), err)
+	}
+	var tests = []struct {
+		key      string
+		expected interface{}
+	}{
+		{"remote_ip", "10.0.0.1"},
+		{"user", "alice"},
+		{"method", "POST"},
+		{"uri", "/articles?x=1"},
+		{"status", float64(201)},
+		{"bytes", float64(5)},
+		{"user_agent", "test-agent"},
+	}
+	for _, test := range tests {
+		if entry[test.key] != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.key, test.expected, entry[test.key])
+		}
+	}
+	if _, ok := entry["duration_ms"]; !ok {
+		t.Error("missing duration_ms")
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	var tests = []struct {
+		input    string
+		expected Format
+		ok       bool
+	}{
+		{"", Combined, true},
+		{"combined", Combined, true},
+		{"JSON", JSON, true},
+		{"xml", "", false},
+	}
+	for _, test := range tests {
+		f, err := ParseFormat(test.input)
+		if f != test.expected || (err == nil) != test.ok {
+			t.Errorf("ParseFormat(%q) = %q, %v", test.input, f, err)
+		}
+	}
+}
+
+// fakeClock is a manually advanced clock for Writer.now.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func TestSizeRotationCompressionAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	w, err := Open(path, Options{MaxSize: 20, Compress: true, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Date(2024, 1, 2, 15, 0, 0, 0, time.Local)}
+	w.now = clock.now
+
+	for i := 0; i < 5; i++ {
+		clock.advance(time.Second)
+		if _, err := w.Write([]byte("0123456789abcdef\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := w.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 retained backups, got %v", backups)
+	}
+	for _, name := range backups {
+		if !strings.HasSuffix(name, ".log.gz") {
+			t.Errorf("expected gzipped backup, got %s", name)
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(zr)
+		f.Close()
+		if string(data) != "0123456789abcdef\n" {
+			t.Errorf("%s: unexpected content %q", name, data)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "0123456789abcdef\n" {
+		t.Errorf("current file: unexpected content %q", data)
+	}
+}
+
+func TestTimeRotationAndMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	w, err := Open(path, Options{RotateEvery: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Date(2024, 1, 2, 15, 0, 0, 0, time.Local)}
+	w.now = clock.now
+	w.opened = clock.now()
+
+	// Writes at 15:40 and 16:20 (rotates, backup stamped 16:20), 17:00,
+	// 17:40 (rotates, backup stamped 17:40) and 18:20.
+	for i := 0; i < 5; i++ {
+		clock.advance(40 * time.Minute)
+		if _, err := w.Write([]byte("line\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	backups, _ := w.backups()
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+
+	// At 20:20 the 16:20 backup is past MaxAge and pruned on the next
+	// rotation, the 17:40 one is kept.
+	w, err = Open(path, Options{MaxAge: 3 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(2 * time.Hour)
+	w.now = clock.now
+	if err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	backups, _ = w.backups()
+	if len(backups) != 2 || !strings.HasPrefix(backups[0], "access-20240102T202000") || !strings.HasPrefix(backups[1], "access-20240102T174000") {
+		t.Errorf("expected the 20:20 and 17:40 backups to remain, got %v", backups)
+	}
+}
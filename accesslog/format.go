@@ -0,0 +1,124 @@
+// Package accesslog writes HTTP access logs in Apache Combined or JSON line
+// format to a file that rotates by size and/or age, gzipping and pruning
+// the rotated files.
+//
+// It is shared by web-server and basic-api:
+//
+//	w, err := accesslog.Open("logs/access.log", accesslog.Options{MaxSize: 10 << 20, Compress: true})
+//	handler = accesslog.Middleware(w, accesslog.Combined, handler)
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format selects how entries are written.
+type Format string
+
+const (
+	// Combined is the Apache/NGINX "combined" format.
+	Combined Format = "combined"
+	// JSON writes one JSON object per line.
+	JSON Format = "json"
+)
+
+// ParseFormat accepts "combined" (also the empty string) or "json".
+func ParseFormat(s string) (Format, error) {
+	switch Format(strings.ToLower(s)) {
+	case "", Combined:
+		return Combined, nil
+	case JSON:
+		return JSON, nil
+	}
+	return "", fmt.Errorf("accesslog: unknown format %q", s)
+}
+
+// Entry is one served request.
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	RemoteIP  string        `json:"remote_ip"`
+	User      string        `json:"user,omitempty"`
+	Host      string        `json:"host"`
+	Method    string        `json:"method"`
+	URI       string        `json:"uri"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	Duration  time.Duration `json:"-"`
+}
+
+// newEntry fills the request part of an Entry.
+func newEntry(r *http.Request, start time.Time) Entry {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	user := ""
+	if u, _, ok := r.BasicAuth(); ok {
+		user = u
+	} else if r.URL.User != nil {
+		user = r.URL.User.Username()
+	}
+	return Entry{
+		Time:      start,
+		RemoteIP:  ip,
+		User:      user,
+		Host:      r.Host,
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// Line renders the entry in the given format, including the trailing
+// newline.
+func (e Entry) Line(f Format) []byte {
+	if f == JSON {
+		type alias Entry
+		b, _ := json.Marshal(struct {
+			alias
+			DurationMS float64 `json:"duration_ms"`
+		}{alias(e), float64(e.Duration) / float64(time.Millisecond)})
+		return append(b, '\n')
+	}
+
+	var b strings.Builder
+	b.WriteString(orDash(e.RemoteIP))
+	b.WriteString(" - ")
+	b.WriteString(orDash(e.User))
+	b.WriteString(" [")
+	b.WriteString(e.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString("] ")
+	b.WriteString(strconv.Quote(e.Method + " " + e.URI + " " + e.Proto))
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa(e.Status))
+	b.WriteString(" ")
+	if e.Bytes == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString(strconv.FormatInt(e.Bytes, 10))
+	}
+	b.WriteString(" ")
+	b.WriteString(strconv.Quote(orDash(e.Referer)))
+	b.WriteString(" ")
+	b.WriteString(strconv.Quote(orDash(e.UserAgent)))
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,3 @@
+module github.com/alexandreafj/golang-study/accesslog
+
+go 1.19
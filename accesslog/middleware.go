@@ -0,0 +1,69 @@
+package accesslog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Middleware writes one entry per request served by next to w.
+func Middleware(w io.Writer, f Format, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &recorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		e := newEntry(r, start)
+		e.Status = rec.status
+		e.Bytes = rec.bytes
+		e.Duration = time.Since(start)
+		w.Write(e.Line(f))
+	})
+}
+
+// recorder captures the status code and body size of a response.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.wroteHeader && status >= 200 {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush and Hijack are passed through so streaming and WebSocket handlers
+// keep working behind the middleware. They go through a ResponseController
+// to reach writers that only offer them by unwrapping.
+func (r *recorder) Flush() {
+	r.wroteHeader = true
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("accesslog: %w", err)
+	}
+	r.status = http.StatusSwitchingProtocols
+	return conn, rw, nil
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,237 @@
+package accesslog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options controls rotation and retention. The zero value never rotates.
+type Options struct {
+	// MaxSize rotates the file before a write would make it larger than
+	// this many bytes.
+	MaxSize int64
+	// RotateEvery rotates the file once it has been open this long.
+	RotateEvery time.Duration
+	// Compress gzips rotated files in the background.
+	Compress bool
+	// MaxBackups keeps at most this many rotated files (0 keeps all).
+	MaxBackups int
+	// MaxAge removes rotated files older than this (0 keeps all).
+	MaxAge time.Duration
+}
+
+// backupTimeFormat is inserted between the file's base name and extension:
+// access.log becomes access-20240102T150405.000.log(.gz).
+const backupTimeFormat = "20060102T150405.000"
+
+// Writer is an io.Writer appending to a log file that it rotates according
+// to its Options. It is safe for concurrent use.
+type Writer struct {
+	path string
+
+	mu     sync.Mutex
+	opts   Options
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// now is replaced in tests.
+	now func() time.Time
+	// compressing tracks background gzip/prune jobs so Close can wait for
+	// them; housekeeping runs them one at a time.
+	compressing  sync.WaitGroup
+	housekeeping sync.Mutex
+}
+
+// Open opens (or creates) the log file at path, creating its directory if
+// needed.
+func Open(path string, opts Options) (*Writer, error) {
+	w := &Writer{path: path, opts: opts, now: time.Now}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// SetOptions changes the rotation settings of an open Writer.
+func (w *Writer) SetOptions(opts Options) {
+	w.mu.Lock()
+	w.opts = opts
+	w.mu.Unlock()
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = fi.Size()
+	w.opened = w.now()
+	return nil
+}
+
+// Write appends p to the file, rotating first when p would exceed MaxSize
+// or the file is older than RotateEvery.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	tooBig := w.opts.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.opts.MaxSize
+	tooOld := w.opts.RotateEvery > 0 && w.now().Sub(w.opened) >= w.opts.RotateEvery
+	if tooBig || tooOld {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate closes the current file, renames it with a timestamp and starts a
+// new one.
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotate()
+}
+
+func (w *Writer) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		w.file = nil
+	}
+
+	ext := filepath.Ext(w.path)
+	backup := strings.TrimSuffix(w.path, ext) + "-" + w.now().Format(backupTimeFormat) + ext
+	if err := os.Rename(w.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	opts := w.opts
+	w.compressing.Add(1)
+	go func() {
+		defer w.compressing.Done()
+		w.housekeeping.Lock()
+		defer w.housekeeping.Unlock()
+		if opts.Compress {
+			compressFile(backup)
+		}
+		w.prune(opts)
+	}()
+	return nil
+}
+
+// Close waits for pending compression and closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	w.mu.Unlock()
+	w.compressing.Wait()
+	return err
+}
+
+// backups returns the rotated files of w, newest first.
+func (w *Writer) backups() ([]string, error) {
+	ext := filepath.Ext(w.path)
+	base := filepath.Base(strings.TrimSuffix(w.path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(w.path))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		stamp := strings.TrimPrefix(name, base)
+		if stamp == name || e.IsDir() {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, ".gz"), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			names = append(names, name)
+		}
+	}
+	// The timestamp format sorts lexically.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// prune removes rotated files beyond MaxBackups or older than MaxAge.
+func (w *Writer) prune(opts Options) {
+	names, err := w.backups()
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(w.path)
+	ext := filepath.Ext(w.path)
+	base := filepath.Base(strings.TrimSuffix(w.path, ext)) + "-"
+	for i, name := range names {
+		remove := opts.MaxBackups > 0 && i >= opts.MaxBackups
+		if opts.MaxAge > 0 {
+			stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, base), ".gz"), ext)
+			if t, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local); err == nil && w.now().Sub(t) > opts.MaxAge {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+// compressFile replaces path with path.gz.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -2,4 +2,9 @@ module github.com/alexandreafj/golang-study/basic-api
 
 go 1.19
 
-require github.com/gorilla/mux v1.8.0 // indirect
+require (
+	github.com/alexandreafj/golang-study/accesslog v0.0.0
+	github.com/gorilla/mux v1.8.0
+)
+
+replace github.com/alexandreafj/golang-study/accesslog => ../accesslog
@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"time"
 
+	"github.com/alexandreafj/golang-study/accesslog"
 	"github.com/gorilla/mux"
 )
 
@@ -35,11 +36,7 @@ func homePage(w http.ResponseWriter, r *http.Request){
     fmt.Println("Endpoint Hit: homePage")
 }
 
-func gracefullyShutdown(srv *http.Server) {
-    var wait time.Duration
-    flag.DurationVar(&wait, "graceful-timeout", time.Second * 15, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
-    flag.Parse()
-
+func gracefullyShutdown(srv *http.Server, wait time.Duration) {
     // Run our server in a goroutine so that it doesn't block.
     go func() {
         if err := srv.ListenAndServe(); err != nil {
@@ -74,20 +71,46 @@ func initControllers(router *mux.Router) {
 }
 
 func startServer(){
+    var wait time.Duration
+    flag.DurationVar(&wait, "graceful-timeout", time.Second * 15, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
+    accessLogPath := flag.String("access-log", "", "file to write the access log to, e.g. logs/access.log (disabled when empty)")
+    accessLogFormat := flag.String("access-log-format", "combined", "access log format: combined or json")
+    accessLogMaxSize := flag.Int64("access-log-max-size", 10, "rotate the access log after this many megabytes (0 disables)")
+    accessLogBackups := flag.Int("access-log-backups", 7, "number of gzipped rotated access logs to keep")
+    flag.Parse()
+
     r := mux.NewRouter().StrictSlash(true)
     r.Use(mux.CORSMethodMiddleware(r))
     initControllers(r)
+
+    var handler http.Handler = r // Pass our instance of gorilla/mux in.
+    if *accessLogPath != "" {
+        format, err := accesslog.ParseFormat(*accessLogFormat)
+        if err != nil {
+            log.Fatal(err)
+        }
+        w, err := accesslog.Open(*accessLogPath, accesslog.Options{
+            MaxSize:    *accessLogMaxSize << 20,
+            Compress:   true,
+            MaxBackups: *accessLogBackups,
+        })
+        if err != nil {
+            log.Fatal(err)
+        }
+        handler = accesslog.Middleware(w, format, r)
+    }
+
     srv := &http.Server{
         Addr:         ":8081",
         // Good practice to set timeouts to avoid Slowloris attacks.
         WriteTimeout: time.Second * 15,
         ReadTimeout:  time.Second * 15,
         IdleTimeout:  time.Second * 60,
-        Handler: r, // Pass our instance of gorilla/mux in.
+        Handler: handler,
     }
 
     fmt.Printf("server runnig on port 8001")
-    gracefullyShutdown(srv)
+    gracefullyShutdown(srv, wait)
 }
 
 func main() {
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// batchCommand looks up many hosts at once: one hostname per line of a
+// file or stdin, every requested record type, a bounded number of hosts in
+// flight. A failed lookup becomes an error column, never the end of the
+// run.
+func batchCommand() cli.Command {
+	var names []string
+	for _, lt := range lookupTypes {
+		names = append(names, lt.name)
+	}
+	return cli.Command{
+		Name:      "batch",
+		Usage:     "Runs lookups for every host of a file or stdin, writing CSV or NDJSON",
+		ArgsUsage: "[file]",
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "type, t",
+				Value: "ip",
+				Usage: "comma separated lookups to run for every host: " + strings.Join(names, ", "),
+			},
+			cli.StringFlag{Name: "format, f", Value: "csv", Usage: "output format: csv or ndjson"},
+			cli.IntFlag{Name: "workers, w", Value: 10, Usage: "hosts looked up concurrently"},
+			cli.DurationFlag{Name: "host-timeout", Value: 15 * time.Second, Usage: "time allowed for all lookups of one host"},
+		}, resolverFlags...),
+		Action: func(c *cli.Context) error {
+			var types []lookupType
+			for _, name := range strings.Split(c.String("type"), ",") {
+				lt, ok := findLookup(strings.TrimSpace(name))
+				if !ok {
+					return usageError{fmt.Errorf("unknown lookup %q (want %s)", name, strings.Join(names, ", "))}
+				}
+				types = append(types, lt)
+			}
+			format := c.String("format")
+			if format != "csv" && format != "ndjson" {
+				return usageError{fmt.Errorf("unknown batch format %q (want csv or ndjson)", format)}
+			}
+			client, err := newDNSClient(c)
+			if err != nil {
+				return err
+			}
+
+			in := io.Reader(os.Stdin)
+			if file := c.Args().First(); file != "" && file != "-" {
+				f, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+			hosts, err := readHosts(in)
+			if err != nil {
+				return err
+			}
+
+			b := &batch{client: client, types: types, workers: c.Int("workers"), hostTimeout: c.Duration("host-timeout")}
+			failed, err := b.run(hosts, newBatchWriter(c.App.Writer, format))
+			if err != nil {
+				return err
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d lookups failed", failed, len(hosts)*len(types))
+			}
+			return nil
+		},
+	}
+}
+
+// readHosts returns the hostnames of r, one per line; blank lines and
+// lines starting with # are skipped.
+func readHosts(r io.Reader) ([]string, error) {
+	var hosts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	return hosts, scanner.Err()
+}
+
+type batch struct {
+	client      *dnsClient
+	types       []lookupType
+	workers     int
+	hostTimeout time.Duration
+}
+
+// run looks up all hosts and writes their results in input order as they
+// complete. It returns the number of failed lookups.
+func (b *batch) run(hosts []string, w batchWriter) (failed int, err error) {
+	workers := b.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	done := make([]chan []result, len(hosts))
+	for i := range done {
+		done[i] = make(chan []result, 1)
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				done[i] <- b.lookupHost(hosts[i])
+			}
+		}()
+	}
+	go func() {
+		for i := range hosts {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	// Results are written in input order; a slow host only holds back the
+	// output, not the workers.
+	for i := range hosts {
+		for _, res := range <-done[i] {
+			if res.Error != "" {
+				failed++
+			}
+			if err := w.write(res); err != nil {
+				// Let the workers finish before giving up.
+				for j := i + 1; j < len(hosts); j++ {
+					<-done[j]
+				}
+				wg.Wait()
+				return failed, err
+			}
+		}
+	}
+	wg.Wait()
+	return failed, w.flush()
+}
+
+func (b *batch) lookupHost(host string) []result {
+	ctx := context.Background()
+	if b.hostTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.hostTimeout)
+		defer cancel()
+	}
+	results := make([]result, len(b.types))
+	for i, lt := range b.types {
+		res := result{Host: host, Type: lt.typ, Records: []record{}}
+		records, err := lt.lookup(ctx, b.client, host)
+		if records != nil {
+			res.Records = records
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		results[i] = res
+	}
+	return results
+}
+
+// batchWriter writes batch results in one of the batch formats.
+type batchWriter interface {
+	write(res result) error
+	flush() error
+}
+
+func newBatchWriter(w io.Writer, format string) batchWriter {
+	if format == "ndjson" {
+		return ndjsonWriter{json.NewEncoder(w)}
+	}
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (w ndjsonWriter) write(res result) error {
+	return w.enc.Encode(res)
+}
+
+func (w ndjsonWriter) flush() error {
+	return nil
+}
+
+// csvWriter writes one row per host and lookup with the record values
+// joined by "; ", their TTLs in the same order and the error, if any, in
+// the last column.
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (w *csvWriter) write(res result) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	values := make([]string, len(res.Records))
+	ttls := make([]string, len(res.Records))
+	for i, r := range res.Records {
+		values[i] = r.Value
+		ttls[i] = strconv.FormatUint(uint64(r.TTL), 10)
+	}
+	w.w.Write([]string{res.Host, res.Type, strings.Join(values, "; "), strings.Join(ttls, "; "), res.Error})
+	// Flush every row so a long batch can be followed while it runs.
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *csvWriter) writeHeader() error {
+	if w.header {
+		return nil
+	}
+	w.header = true
+	return w.w.Write([]string{"host", "type", "records", "ttls", "error"})
+}
+
+func (w *csvWriter) flush() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
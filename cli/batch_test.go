@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func TestBatchCommand(t *testing.T) {
+	host, port, _ := net.SplitHostPort(startDNS(t,
+		"one.example. 300 IN A 192.0.2.1",
+		`one.example. 300 IN TXT "hello"`,
+		"two.example. 300 IN A 192.0.2.2",
+		"two.example. 300 IN A 192.0.2.3",
+	))
+	file := filepath.Join(t.TempDir(), "hosts.txt")
+	os.WriteFile(file, []byte("# audit list\none.example\n\nmissing.example\ntwo.example\n"), 0o644)
+
+	run := func(args ...string) (string, error) {
+		app := cli.NewApp()
+		app.Commands = []cli.Command{batchCommand()}
+		var out bytes.Buffer
+		app.Writer = &out
+		args = append([]string{"cli", "batch", "--server", host, "--port", port, "--retries", "0"}, args...)
+		err := app.Run(append(args, file))
+		return out.String(), err
+	}
+
+	out, err := run("-t", "a,txt")
+	want := `host,type,records,ttls,error
+one.example,A,192.0.2.1,300,
+one.example,TXT,"""hello""",300,
+missing.example,A,,,lookup missing.example: no such host (NXDOMAIN)
+missing.example,TXT,,,lookup missing.example: no such host (NXDOMAIN)
+two.example,A,192.0.2.2; 192.0.2.3,300; 300,
+two.example,TXT,,,
+`
+	if out != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out)
+	}
+	if err == nil || exitCode(err) != 1 || !strings.Contains(err.Error(), "2 of 6") {
+		t.Errorf("expected 2 of 6 lookups to fail, got %v", err)
+	}
+
+	out, _ = run("-t", "a", "-f", "ndjson")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 NDJSON lines, got %q", out)
+	}
+	var res result
+	if err := json.Unmarshal([]byte(lines[2]), &res); err != nil || res.Host != "two.example" || len(res.Records) != 2 {
+		t.Errorf("unexpected NDJSON line %q: %v", lines[2], err)
+	}
+
+	for _, args := range [][]string{{"-t", "bogus"}, {"-f", "xml"}} {
+		if _, err := run(args...); exitCode(err) != 2 {
+			t.Errorf("%v: expected a usage error, got %v", args, err)
+		}
+	}
+}
+
+func TestBatchWorkersAndTimeout(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	slow := lookupType{name: "slow", typ: "A", lookup: func(ctx context.Context, _ *dnsClient, host string) ([]record, error) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		if host == "hang.example" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		time.Sleep(10 * time.Millisecond)
+		return []record{{Name: host, Type: "A", Value: "192.0.2.1"}}, nil
+	}}
+
+	hosts := []string{"hang.example"}
+	for i := 0; i < 20; i++ {
+		hosts = append(hosts, "ok.example")
+	}
+	b := &batch{types: []lookupType{slow}, workers: 3, hostTimeout: 100 * time.Millisecond}
+	var out bytes.Buffer
+	failed, err := b.run(hosts, newBatchWriter(&out, "csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed != 1 || !strings.Contains(out.String(), context.DeadlineExceeded.Error()) {
+		t.Errorf("expected the hanging host to time out, got %d failures:\n%s", failed, out.String())
+	}
+	if peak > 3 {
+		t.Errorf("%d lookups ran at once with 3 workers", peak)
+	}
+	if !strings.HasPrefix(out.String(), "host,type,records,ttls,error\nhang.example,") {
+		t.Errorf("results out of input order:\n%s", out.String())
+	}
+}
+
+func TestReadHosts(t *testing.T) {
+	hosts, err := readHosts(strings.NewReader("a.example\n  b.example  \n# c.example\n\n"))
+	if err != nil || strings.Join(hosts, ",") != "a.example,b.example" {
+		t.Errorf("unexpected hosts %q: %v", hosts, err)
+	}
+	if _, err := readHosts(errReader{}); err == nil {
+		t.Error("expected the read error")
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("broken") }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+)
+
+// dnsCache keeps answers on disk for as long as their TTLs allow, one file
+// per question and resolver. It is best effort: a cache that can't be read
+// or written is a miss, never an error.
+type dnsCache struct {
+	dir string
+	now func() time.Time
+}
+
+// cacheEntry is one cached answer. Answers are in zone file syntax with
+// the TTLs they had when stored.
+type cacheEntry struct {
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+	Rcode   int       `json:"rcode"`
+	Answers []string  `json:"answers"`
+}
+
+// defaultCacheDir is under the user's cache directory, e.g. ~/.cache.
+func defaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "website-lookup-cli", "dns"), nil
+}
+
+func newDNSCache() *dnsCache {
+	dir, err := defaultCacheDir()
+	if err != nil {
+		return nil
+	}
+	return &dnsCache{dir: dir, now: time.Now}
+}
+
+// path returns the file of a question asked of a resolver.
+func (c *dnsCache) path(transport, server, name string, qtype uint16) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{transport, server, strings.ToLower(name), dns.TypeToString[qtype]}, "|")))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// get returns the cached response at path with its TTLs counted down, or
+// nil when there is none or it expired.
+func (c *dnsCache) get(path string) *dns.Msg {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var e cacheEntry
+	now := c.now()
+	if json.Unmarshal(data, &e) != nil || !now.Before(e.Expires) {
+		os.Remove(path)
+		return nil
+	}
+	elapsed := uint32(now.Sub(e.Stored) / time.Second)
+
+	m := &dns.Msg{}
+	m.Rcode = e.Rcode
+	for _, s := range e.Answers {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil
+		}
+		if h := rr.Header(); h.Ttl > elapsed {
+			h.Ttl -= elapsed
+		} else {
+			h.Ttl = 0
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+// put stores resp at path until its shortest TTL runs out. Negative
+// answers (NXDOMAIN, no records) are kept as long as the SOA that comes
+// with them allows; without one they aren't kept.
+func (c *dnsCache) put(path string, resp *dns.Msg) {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return
+	}
+	var ttl uint32
+	e := cacheEntry{Stored: c.now(), Rcode: resp.Rcode, Answers: []string{}}
+	if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0 {
+		ttl = resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer {
+			ttl = min(ttl, rr.Header().Ttl)
+			e.Answers = append(e.Answers, rr.String())
+		}
+	} else {
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = min(soa.Hdr.Ttl, soa.Minttl)
+			}
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	e.Expires = e.Stored.Add(time.Duration(ttl) * time.Second)
+
+	data, err := json.Marshal(e)
+	if err != nil || os.MkdirAll(c.dir, 0o700) != nil {
+		return
+	}
+	// Write and rename so concurrent lookups never read half an entry.
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || os.Rename(tmp.Name(), path) != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// clear removes every entry and returns how many there were.
+func (c *dnsCache) clear() (int, error) {
+	entries, err := os.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if err := os.Remove(filepath.Join(c.dir, e.Name())); err != nil {
+			return n, err
+		}
+		if !strings.HasPrefix(e.Name(), ".tmp-") {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func cacheCommand() cli.Command {
+	return cli.Command{
+		Name:  "cache",
+		Usage: "Manages the on-disk cache of DNS answers",
+		Subcommands: []cli.Command{
+			{
+				Name:  "clear",
+				Usage: "Removes every cached answer",
+				Action: func(c *cli.Context) error {
+					cache := newDNSCache()
+					if cache == nil {
+						return fmt.Errorf("no user cache directory")
+					}
+					n, err := cache.clear()
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(c.App.Writer, "removed %d cached answers from %s\n", n, cache.dir)
+					return nil
+				},
+			},
+			{
+				Name:  "path",
+				Usage: "Prints the cache directory",
+				Action: func(c *cli.Context) error {
+					dir, err := defaultCacheDir()
+					if err != nil {
+						return err
+					}
+					fmt.Fprintln(c.App.Writer, dir)
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+)
+
+// TestMain keeps the commands run by the tests from caching answers in
+// the user's cache directory.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "cli-cache")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_CACHE_HOME", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestCache(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cache := &dnsCache{dir: t.TempDir(), now: func() time.Time { return now }}
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	path := cache.path("udp", "192.0.2.53:53", "example.com.", dns.TypeA)
+	if cache.path("udp", "192.0.2.53:53", "EXAMPLE.com.", dns.TypeA) != path || cache.path("tcp", "192.0.2.53:53", "example.com.", dns.TypeA) == path {
+		t.Error("cache paths must ignore case but not the resolver")
+	}
+	resp := &dns.Msg{Answer: []dns.RR{rr("example.com. 300 IN A 192.0.2.1"), rr("example.com. 60 IN A 192.0.2.2")}}
+	cache.put(path, resp)
+
+	now = now.Add(45 * time.Second)
+	got := cache.get(path)
+	if got == nil || len(got.Answer) != 2 || got.Answer[0].Header().Ttl != 255 || got.Answer[1].Header().Ttl != 15 {
+		t.Fatalf("expected the answers with 45s less TTL, got %v", got)
+	}
+	// The shortest TTL decides when the answer expires.
+	now = now.Add(15 * time.Second)
+	if got := cache.get(path); got != nil {
+		t.Errorf("expected the answer to expire, got %v", got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the expired entry was not removed")
+	}
+
+	// Negative answers live as long as the SOA allows; without a SOA or
+	// with a zero TTL they aren't stored.
+	nx := cache.path("udp", "192.0.2.53:53", "missing.example.com.", dns.TypeA)
+	cache.put(nx, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: []dns.RR{rr("example.com. 3600 IN SOA ns1.example.com. admin.example.com. 1 7200 900 1209600 30")}})
+	if got := cache.get(nx); got == nil || got.Rcode != dns.RcodeNameError {
+		t.Errorf("expected the cached NXDOMAIN, got %v", got)
+	}
+	for _, resp := range []*dns.Msg{
+		{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}},
+		{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}},
+		{Answer: []dns.RR{rr("example.com. 0 IN A 192.0.2.1")}},
+	} {
+		p := cache.path("udp", "192.0.2.53:53", "other.example.com.", dns.TypeA)
+		cache.put(p, resp)
+		if got := cache.get(p); got != nil {
+			t.Errorf("expected %v not to be cached, got %v", resp, got)
+		}
+	}
+
+	if n, err := cache.clear(); err != nil || n != 1 {
+		t.Errorf("expected to clear 1 entry, got %d: %v", n, err)
+	}
+	if entries, _ := os.ReadDir(cache.dir); len(entries) != 0 {
+		t.Errorf("entries left after clear: %v", entries)
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	// Count the queries reaching the server.
+	var queries atomic.Int32
+	upstream := startDNS(t, testZone...)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		resp, err := dns.Exchange(req, upstream)
+		if err == nil {
+			w.WriteMsg(resp)
+		}
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	cache := &dnsCache{dir: t.TempDir(), now: time.Now}
+	c := &dnsClient{server: pc.LocalAddr().String(), timeout: time.Second, cache: cache}
+	for i := 0; i < 3; i++ {
+		records, err := recordLookup(dns.TypeA)(context.Background(), c, "example.com")
+		if err != nil || len(records) != 1 || records[0].TTL == 0 || records[0].TTL > 300 {
+			t.Fatalf("unexpected records %v: %v", records, err)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("expected 1 query with the cache, got %d", n)
+	}
+
+	c.cache = nil
+	recordLookup(dns.TypeA)(context.Background(), c, "example.com")
+	if n := queries.Load(); n != 2 {
+		t.Errorf("expected a query without the cache, got %d", n-1)
+	}
+}
+
+func TestCacheCommand(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	dir, err := defaultCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(dir, 0o700)
+	os.WriteFile(filepath.Join(dir, "entry"), []byte("{}"), 0o600)
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{cacheCommand()}
+	var out bytes.Buffer
+	app.Writer = &out
+	if err := app.Run([]string{"cli", "cache", "clear"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "removed 1 cached answers from "+dir) {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("entries left after clear: %v", entries)
+	}
+
+	// newDNSClient uses the cache unless told not to.
+	for _, test := range []struct {
+		args  []string
+		cache bool
+	}{{nil, true}, {[]string{"--no-cache"}, false}} {
+		app := cli.NewApp()
+		app.Flags = resolverFlags
+		var client *dnsClient
+		app.Action = func(c *cli.Context) error {
+			client, err = newDNSClient(c)
+			return err
+		}
+		app.Run(append([]string{"cli", "--server", "192.0.2.53"}, test.args...))
+		if client == nil || (client.cache != nil) != test.cache || test.cache && client.cache.dir != dir {
+			t.Errorf("%v: expected cache=%v, got %+v", test.args, test.cache, client)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+)
+
+// serverAnswers is what one authoritative server of a zone answered.
+// Answers maps "name TYPE" to the sorted record values, "(none)" or the
+// error of that query.
+type serverAnswers struct {
+	Server  string            `json:"server" yaml:"server"`
+	Address string            `json:"address" yaml:"address"`
+	Serial  uint32            `json:"serial" yaml:"serial"`
+	Answers map[string]string `json:"answers,omitempty" yaml:"answers,omitempty"`
+	Error   string            `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// checkReport is what the check command prints.
+type checkReport struct {
+	Zone       string          `json:"zone" yaml:"zone"`
+	Servers    []serverAnswers `json:"servers" yaml:"servers"`
+	Mismatches []string        `json:"mismatches" yaml:"mismatches"`
+}
+
+// checker asks every name server of a zone the same questions, without
+// recursion, so servers that missed a change stand out.
+type checker struct {
+	// client finds the name servers and their addresses, and sets the
+	// timeout and retries of the queries to them.
+	client *dnsClient
+	// port is where the name servers are asked.
+	port  string
+	names []string
+	types []uint16
+}
+
+// check queries all name servers of zone and compares their SOA serials
+// and answers.
+func (ch *checker) check(ctx context.Context, zone string) (checkReport, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	report := checkReport{Zone: zone, Mismatches: []string{}}
+
+	ns, _ := findLookup("ns")
+	records, err := ns.lookup(ctx, ch.client, zone)
+	if err != nil {
+		return report, err
+	}
+	if len(records) == 0 {
+		return report, fmt.Errorf("check: %s has no NS records", zone)
+	}
+	var names []string
+	for _, r := range records {
+		names = append(names, strings.ToLower(r.Value))
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		addrs, err := ch.client.query(ctx, name, dns.TypeA)
+		if err == nil && len(addrs) == 0 {
+			addrs, err = ch.client.query(ctx, name, dns.TypeAAAA)
+		}
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no address for %s", name)
+		}
+		if err != nil {
+			report.Servers = append(report.Servers, serverAnswers{Server: name, Error: err.Error()})
+			continue
+		}
+		for _, rr := range addrs {
+			var addr string
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr = rr.A.String()
+			case *dns.AAAA:
+				addr = rr.AAAA.String()
+			}
+			report.Servers = append(report.Servers, ch.ask(ctx, zone, name, addr))
+		}
+	}
+
+	report.Mismatches = compareServers(report.Servers, ch.questions(zone))
+	return report, nil
+}
+
+// questions returns the "name TYPE" keys asked of every server.
+func (ch *checker) questions(zone string) []string {
+	names := ch.names
+	if len(names) == 0 {
+		names = []string{zone}
+	}
+	var keys []string
+	for _, name := range names {
+		for _, qtype := range ch.types {
+			keys = append(keys, dns.Fqdn(strings.ToLower(name))+" "+dns.TypeToString[qtype])
+		}
+	}
+	return keys
+}
+
+// ask sends the SOA and every question to one server.
+func (ch *checker) ask(ctx context.Context, zone, name, addr string) serverAnswers {
+	s := serverAnswers{Server: name, Address: addr, Answers: make(map[string]string)}
+	transport := "udp"
+	if ch.client.transport == "tcp" {
+		transport = "tcp"
+	}
+	server := &dnsClient{
+		transport: transport,
+		server:    net.JoinHostPort(addr, ch.port),
+		timeout:   ch.client.timeout,
+		retries:   ch.client.retries,
+	}
+
+	soa, err := askAuthoritative(ctx, server, zone, dns.TypeSOA)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	if len(soa) == 0 {
+		s.Error = "no SOA record for " + zone
+		return s
+	}
+	s.Serial = soa[0].(*dns.SOA).Serial
+
+	for _, key := range ch.questions(zone) {
+		name, typ, _ := strings.Cut(key, " ")
+		answers, err := askAuthoritative(ctx, server, name, dns.StringToType[typ])
+		switch {
+		case err != nil:
+			s.Answers[key] = "error: " + err.Error()
+		case len(answers) == 0:
+			s.Answers[key] = "(none)"
+		default:
+			values := make([]string, len(answers))
+			for i, rr := range answers {
+				values[i] = rrRecord(rr).Value
+			}
+			sort.Strings(values)
+			s.Answers[key] = strings.Join(values, "; ")
+		}
+	}
+	return s
+}
+
+// askAuthoritative asks server for the records of type qtype at name
+// without recursion. A server that isn't authoritative for the name is
+// lame, which is an error here.
+func askAuthoritative(ctx context.Context, server *dnsClient, name string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+
+	resp, err := server.exchange(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := rcodeError(name, resp.Rcode); err != nil {
+		return nil, err
+	}
+	if !resp.Authoritative {
+		return nil, fmt.Errorf("not authoritative for %s (lame delegation)", name)
+	}
+	var answers []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype {
+			answers = append(answers, rr)
+		}
+	}
+	return answers, nil
+}
+
+// compareServers lists every disagreement between the servers: failures,
+// SOA serials and answers to the same question.
+func compareServers(servers []serverAnswers, questions []string) []string {
+	mismatches := []string{}
+	var ok []serverAnswers
+	for _, s := range servers {
+		if s.Error != "" {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %s", serverLabel(s), s.Error))
+			continue
+		}
+		ok = append(ok, s)
+	}
+
+	serials := make(map[string][]string)
+	for _, s := range ok {
+		serial := fmt.Sprint(s.Serial)
+		serials[serial] = append(serials[serial], serverLabel(s))
+	}
+	if len(serials) > 1 {
+		mismatches = append(mismatches, "SOA serial differs: "+describeGroups(serials))
+	}
+
+	for _, key := range questions {
+		groups := make(map[string][]string)
+		for _, s := range ok {
+			groups[s.Answers[key]] = append(groups[s.Answers[key]], serverLabel(s))
+		}
+		if len(groups) > 1 {
+			mismatches = append(mismatches, key+" differs: "+describeGroups(groups))
+		}
+	}
+	return mismatches
+}
+
+func serverLabel(s serverAnswers) string {
+	if s.Address == "" {
+		return s.Server
+	}
+	return s.Server + " (" + s.Address + ")"
+}
+
+// describeGroups prints which servers gave which answer, in a stable order.
+func describeGroups(groups map[string][]string) string {
+	answers := make([]string, 0, len(groups))
+	for answer := range groups {
+		answers = append(answers, answer)
+	}
+	sort.Strings(answers)
+	parts := make([]string, len(answers))
+	for i, answer := range answers {
+		parts[i] = fmt.Sprintf("%q from %s", answer, strings.Join(groups[answer], ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func checkCommand() cli.Command {
+	return cli.Command{
+		Name:      "check",
+		Usage:     "Compares the SOA serial and answers of every name server of a zone",
+		ArgsUsage: "[zone]",
+		Flags: append(append([]cli.Flag{}, lookupFlags...),
+			cli.StringFlag{Name: "type, t", Value: "NS,A,AAAA,MX,TXT", Usage: "comma separated record types to compare"},
+			cli.StringSliceFlag{Name: "name", Usage: "name in the zone to compare, repeatable (default: the zone itself)"},
+		),
+		Action: func(c *cli.Context) error {
+			format := c.String("output")
+			if !validFormat(format) {
+				return usageError{fmt.Errorf("unknown output format %q (want one of %s)", format, strings.Join(outputFormats, ", "))}
+			}
+			ch := &checker{port: "53", names: c.StringSlice("name")}
+			for _, typ := range strings.Split(c.String("type"), ",") {
+				qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(typ))]
+				if !ok {
+					return usageError{fmt.Errorf("unknown record type %q", typ)}
+				}
+				ch.types = append(ch.types, qtype)
+			}
+			client, err := newDNSClient(c)
+			if err != nil {
+				return err
+			}
+			ch.client = client
+			zone := c.String("host")
+			if c.NArg() > 0 {
+				zone = c.Args().First()
+			}
+
+			report, err := ch.check(context.Background(), zone)
+			if err != nil {
+				return err
+			}
+			switch format {
+			case "json", "yaml":
+				err = printValue(c.App.Writer, format, report)
+			case "table":
+				err = printCheckTable(c.App.Writer, report, ch.questions(report.Zone))
+			default:
+				err = printCheck(c.App.Writer, report)
+			}
+			if err != nil {
+				return err
+			}
+			if n := len(report.Mismatches); n > 0 {
+				return fmt.Errorf("%d mismatches between the name servers of %s", n, report.Zone)
+			}
+			return nil
+		},
+	}
+}
+
+// printCheck prints the servers with their serials, then the mismatches.
+func printCheck(w io.Writer, report checkReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, s := range report.Servers {
+		status := fmt.Sprintf("serial %d", s.Serial)
+		if s.Error != "" {
+			status = "error: " + s.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Server, s.Address, status)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(report.Mismatches) == 0 {
+		_, err := fmt.Fprintf(w, "all %d name servers of %s agree\n", len(report.Servers), report.Zone)
+		return err
+	}
+	for _, m := range report.Mismatches {
+		if _, err := fmt.Fprintln(w, "mismatch:", m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printCheckTable prints one row per server and question.
+func printCheckTable(w io.Writer, report checkReport, questions []string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tADDRESS\tSERIAL\tQUESTION\tANSWER")
+	for _, s := range report.Servers {
+		if s.Error != "" {
+			fmt.Fprintf(tw, "%s\t%s\t\t\terror: %s\n", s.Server, s.Address, s.Error)
+			continue
+		}
+		for _, q := range questions {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", s.Server, s.Address, s.Serial, q, s.Answers[q])
+		}
+	}
+	return tw.Flush()
+}
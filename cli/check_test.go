@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+)
+
+// startNameServers runs a resolver that knows example.'s two name servers
+// and returns a checker for them, with ns1 serving zone1 and ns2 zone2. A
+// nil zone leaves that server down.
+func startNameServers(t *testing.T, zone1, zone2 []string) *checker {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+
+	if zone1 != nil {
+		startDNSOn(t, "127.0.0.2:"+port, zone1...)
+	}
+	if zone2 != nil {
+		startDNSOn(t, "127.0.0.3:"+port, zone2...)
+	}
+	resolver := startDNS(t,
+		"example. 300 IN NS ns1.example.",
+		"example. 300 IN NS ns2.example.",
+		"ns1.example. 300 IN A 127.0.0.2",
+		"ns2.example. 300 IN A 127.0.0.3",
+	)
+	return &checker{
+		client: &dnsClient{server: resolver, timeout: 200 * time.Millisecond},
+		port:   port,
+		types:  []uint16{dns.TypeNS, dns.TypeA, dns.TypeMX},
+	}
+}
+
+func exampleZone(serial, addr string) []string {
+	return []string{
+		"example. 3600 IN SOA ns1.example. admin.example. " + serial + " 7200 900 1209600 300",
+		"example. 300 IN NS ns1.example.",
+		"example. 300 IN NS ns2.example.",
+		"example. 300 IN A " + addr,
+		"www.example. 300 IN A " + addr,
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var tests = []struct {
+		name       string
+		zone1      []string
+		zone2      []string
+		names      []string
+		mismatches []string
+	}{
+		{"agree", exampleZone("1", "192.0.2.1"), exampleZone("1", "192.0.2.1"), nil, nil},
+		{"stale", exampleZone("2", "192.0.2.2"), exampleZone("1", "192.0.2.1"), []string{"example", "www.example"}, []string{
+			`SOA serial differs: "1" from ns2.example. (127.0.0.3); "2" from ns1.example. (127.0.0.2)`,
+			`example. A differs: "192.0.2.1" from ns2.example. (127.0.0.3); "192.0.2.2" from ns1.example. (127.0.0.2)`,
+			`www.example. A differs: "192.0.2.1" from ns2.example. (127.0.0.3); "192.0.2.2" from ns1.example. (127.0.0.2)`,
+		}},
+		{"down", exampleZone("1", "192.0.2.1"), nil, nil, []string{"ns2.example. (127.0.0.3): "}},
+	}
+	for _, test := range tests {
+		ch := startNameServers(t, test.zone1, test.zone2)
+		ch.names = test.names
+		report, err := ch.check(context.Background(), "example")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(report.Servers) != 2 {
+			t.Errorf("%s: expected 2 servers, got %+v", test.name, report.Servers)
+		}
+		if len(report.Mismatches) != len(test.mismatches) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.mismatches, report.Mismatches)
+			continue
+		}
+		for i, m := range test.mismatches {
+			if !strings.HasPrefix(report.Mismatches[i], m) {
+				t.Errorf("%s: expected %q, got %q", test.name, m, report.Mismatches[i])
+			}
+		}
+	}
+}
+
+func TestCheckLame(t *testing.T) {
+	ch := startNameServers(t, exampleZone("1", "192.0.2.1"), exampleZone("1", "192.0.2.1"))
+	// ns3 answers, but isn't authoritative for the zone.
+	pc, err := net.ListenPacket("udp", "127.0.0.4:"+ch.port)
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.4: %v", err)
+	}
+	lame := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})}
+	go lame.ActivateAndServe()
+	defer lame.Shutdown()
+	ch.client.server = startDNS(t,
+		"example. 300 IN NS ns1.example.",
+		"example. 300 IN NS ns3.example.",
+		"ns1.example. 300 IN A 127.0.0.2",
+		"ns3.example. 300 IN A 127.0.0.4",
+	)
+
+	report, err := ch.check(context.Background(), "example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Mismatches) != 1 || !strings.Contains(report.Mismatches[0], "ns3.example. (127.0.0.4): not authoritative") {
+		t.Errorf("expected ns3 to be lame, got %q", report.Mismatches)
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	ch := startNameServers(t, exampleZone("1", "192.0.2.1"), exampleZone("1", "192.0.2.1"))
+	host, port, _ := net.SplitHostPort(ch.client.server)
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{checkCommand()}
+	var out bytes.Buffer
+	app.Writer = &out
+	// The name servers only listen on the test port, not on 53.
+	err := app.Run([]string{"cli", "check", "--server", host, "--port", port, "--timeout", "100ms", "--retries", "0", "example"})
+	if err == nil || exitCode(err) != 1 {
+		t.Errorf("expected the unreachable servers to fail the check, got %v", err)
+	}
+	if !strings.Contains(out.String(), "mismatch: ns1.example. (127.0.0.2): ") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	err = app.Run([]string{"cli", "check", "-t", "BOGUS", "example"})
+	if exitCode(err) != 2 {
+		t.Errorf("expected a usage error, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/urfave/cli"
+)
+
+// The bash and zsh scripts ask the program itself for candidates through
+// urfave/cli's --generate-bash-completion flag.
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Parse(`# bash completion for {{.Name}}
+_{{.Func}}_bash_autocomplete() {
+  local cur opts
+  COMPREPLY=()
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  if [[ "$cur" == "-"* ]]; then
+    opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} ${cur} --generate-bash-completion )
+  else
+    opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} --generate-bash-completion )
+  fi
+  COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
+  return 0
+}
+complete -o bashdefault -o default -o nospace -F _{{.Func}}_bash_autocomplete {{.Name}}
+`)),
+	"zsh": template.Must(template.New("zsh").Parse(`#compdef {{.Name}}
+_{{.Func}}_zsh_autocomplete() {
+  local -a opts
+  local cur
+  cur=${words[-1]}
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion)}")
+  else
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} --generate-bash-completion)}")
+  fi
+  if [[ "${opts[1]}" != "" ]]; then
+    _describe 'values' opts
+  else
+    _files
+  fi
+}
+compdef _{{.Func}}_zsh_autocomplete {{.Name}}
+`)),
+}
+
+// docApp returns a copy of the app named after the program, the way
+// completion scripts and man pages must refer to it.
+func docApp(c *cli.Context) *cli.App {
+	app := *c.App
+	app.Name = progName(c)
+	return &app
+}
+
+func progName(c *cli.Context) string {
+	if name := c.String("name"); name != "" {
+		return name
+	}
+	return c.App.HelpName
+}
+
+func completionCommand() cli.Command {
+	return cli.Command{
+		Name:      "completion",
+		Usage:     "Prints the shell completion script for bash, zsh or fish",
+		ArgsUsage: "bash|zsh|fish",
+		Description: `Load it in the current shell with, for bash,
+   source <(cli completion bash)
+or install it where the shell looks for completions, e.g.
+   cli completion fish > ~/.config/fish/completions/cli.fish`,
+		Flags: []cli.Flag{progNameFlag},
+		Action: func(c *cli.Context) error {
+			shell := c.Args().First()
+			if shell == "fish" {
+				script, err := docApp(c).ToFishCompletion()
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprint(c.App.Writer, script)
+				return err
+			}
+			tmpl, ok := completionScripts[shell]
+			if !ok {
+				return usageError{fmt.Errorf("unknown shell %q (want bash, zsh or fish)", shell)}
+			}
+			name := progName(c)
+			return tmpl.Execute(c.App.Writer, struct{ Name, Func string }{
+				Name: name,
+				// Shell function names can't hold every character of a
+				// program name.
+				Func: strings.NewReplacer("-", "_", ".", "_").Replace(name),
+			})
+		},
+	}
+}
+
+func manCommand() cli.Command {
+	return cli.Command{
+		Name:  "man",
+		Usage: "Prints the man page, e.g. cli man > /usr/local/share/man/man8/cli.8",
+		Flags: []cli.Flag{progNameFlag},
+		Action: func(c *cli.Context) error {
+			app := docApp(c)
+			app.Description = ""
+			app.UsageText = manDescription
+			page, err := app.ToMan()
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprint(c.App.Writer, page)
+			return err
+		},
+	}
+}
+
+// progNameFlag names the program in the generated scripts and pages.
+var progNameFlag = cli.StringFlag{Name: "name", Usage: "program name the output refers to (default: the name it runs as)"}
+
+const manDescription = `Looks up DNS records of hosts, one record type per command, or many hosts at once with batch. trace, check and mail-audit diagnose delegations, name servers and mail setups; shell runs lookups interactively.
+
+Defaults for the host, resolver and output format can be set in $XDG_CONFIG_HOME/website-lookup-cli/config.yaml (~/.config on Linux), with the keys host, output, server, port, transport (udp, tcp, dot, doh or system), timeout and retries. Flags on the command line override them.
+
+Without --server, lookups query the first nameserver of /etc/resolv.conf; --system goes through the operating system's resolver instead, which reads the hosts file and search domains but reports no TTLs. Answers of the name servers queried directly are cached in $XDG_CACHE_HOME/website-lookup-cli/dns until their TTL runs out; --no-cache skips the cache and cache clear empties it. --watch, shell and mail-audit always ask the resolver.`
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompletionAndMan(t *testing.T) {
+	var tests = []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"completion", "--name", "dns-cli", "bash"}, []string{"_dns_cli_bash_autocomplete()", "-F _dns_cli_bash_autocomplete dns-cli\n", "--generate-bash-completion"}},
+		{[]string{"completion", "--name", "dns-cli", "zsh"}, []string{"#compdef dns-cli\n", "compdef _dns_cli_zsh_autocomplete dns-cli\n"}},
+		{[]string{"completion", "--name", "dns-cli", "fish"}, []string{"complete -c dns-cli", "mail-audit", "-l no-cache"}},
+		{[]string{"man", "--name", "dns-cli"}, []string{".TH dns\\-cli(8)", "config.yaml", "mail\\-audit", "\\-\\-no\\-cache"}},
+	}
+	for _, test := range tests {
+		app := newApp()
+		var out bytes.Buffer
+		app.Writer = &out
+		if err := app.Run(append([]string{"cli"}, test.args...)); err != nil {
+			t.Errorf("%v: %v", test.args, err)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%v: expected %q in\n%s", test.args, want, out.String())
+			}
+		}
+	}
+
+	app := newApp()
+	app.Writer = &bytes.Buffer{}
+	if err := app.Run([]string{"cli", "completion", "tcsh"}); exitCode(err) != 2 {
+		t.Errorf("expected a usage error, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// userConfig holds the user's defaults for the host, resolver and output
+// format. They replace the flag defaults, so the command line still wins
+// and --help shows them.
+type userConfig struct {
+	Host   string `yaml:"host"`
+	Output string `yaml:"output"`
+	Server string `yaml:"server"`
+	Port   int    `yaml:"port"`
+	// Transport is udp, tcp, dot, doh or system.
+	Transport string        `yaml:"transport"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Retries   *int          `yaml:"retries"`
+}
+
+// userConfigPath is config.yaml in the user's config directory, e.g.
+// ~/.config/website-lookup-cli.
+func userConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "website-lookup-cli", "config.yaml"), nil
+}
+
+// loadUserConfig reads the config at path; a missing file is no config.
+func loadUserConfig(path string) (*userConfig, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &userConfig{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Output != "" && !validFormat(cfg.Output) {
+		return nil, fmt.Errorf("%s: unknown output format %q (want one of %s)", path, cfg.Output, strings.Join(outputFormats, ", "))
+	}
+	switch cfg.Transport {
+	case "", "udp", "tcp", "dot", "doh", "system":
+	default:
+		return nil, fmt.Errorf("%s: unknown transport %q (want udp, tcp, dot, doh or system)", path, cfg.Transport)
+	}
+	return cfg, nil
+}
+
+// apply sets the defaults of the matching flags of cmds and their
+// subcommands. The transport becomes a flag that defaults to true.
+func (cfg *userConfig) apply(cmds []cli.Command) {
+	for i := range cmds {
+		cmd := &cmds[i]
+		cfg.apply(cmd.Subcommands)
+		// Commands share flag slices; give each its own before changing it.
+		flags := append([]cli.Flag(nil), cmd.Flags...)
+		for j, f := range flags {
+			name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+			switch f := f.(type) {
+			case cli.StringFlag:
+				switch {
+				case name == "host" && cfg.Host != "":
+					f.Value = cfg.Host
+				case name == "output" && cfg.Output != "":
+					f.Value = cfg.Output
+				case name == "server" && cfg.Server != "":
+					f.Value = cfg.Server
+				}
+				flags[j] = f
+			case cli.IntFlag:
+				switch {
+				case name == "port" && cfg.Port != 0:
+					f.Value = cfg.Port
+				case name == "retries" && cfg.Retries != nil:
+					f.Value = *cfg.Retries
+				}
+				flags[j] = f
+			case cli.DurationFlag:
+				if name == "timeout" && cfg.Timeout > 0 {
+					f.Value = cfg.Timeout
+				}
+				flags[j] = f
+			case cli.BoolFlag:
+				if name == cfg.Transport {
+					flags[j] = cli.BoolTFlag{Name: f.Name, Usage: f.Usage + " (on in the config file)"}
+				}
+			}
+		}
+		cmd.Flags = flags
+	}
+}
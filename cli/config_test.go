@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadUserConfig(t *testing.T) {
+	cfg, err := loadUserConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if cfg != nil || err != nil {
+		t.Errorf("expected no config for a missing file, got %+v %v", cfg, err)
+	}
+
+	cfg, err = loadUserConfig(writeConfig(t, "host: example.com\noutput: json\nserver: 192.0.2.53\nport: 5353\ntransport: dot\ntimeout: 3s\nretries: 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "example.com" || cfg.Output != "json" || cfg.Server != "192.0.2.53" || cfg.Port != 5353 ||
+		cfg.Transport != "dot" || cfg.Timeout != 3*time.Second || cfg.Retries == nil || *cfg.Retries != 0 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	for _, bad := range []string{"hots: example.com\n", "output: xml\n", "transport: quic\n", "port: [1]\n"} {
+		if _, err := loadUserConfig(writeConfig(t, bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestUserConfigApply(t *testing.T) {
+	retries := 0
+	cfg := &userConfig{Host: "example.com", Output: "json", Server: "192.0.2.53", Transport: "tcp", Timeout: 3 * time.Second, Retries: &retries}
+	app := newApp()
+	cfg.apply(app.Commands)
+
+	var tests = []struct {
+		args      []string
+		host      string
+		format    string
+		transport string
+		server    string
+	}{
+		{nil, "example.com", "json", "tcp", "192.0.2.53:53"},
+		{[]string{"--host", "example.org", "-o", "text"}, "example.org", "text", "tcp", "192.0.2.53:53"},
+		{[]string{"--tcp=false"}, "example.com", "json", "udp", "192.0.2.53:53"},
+		{[]string{"--dot", "--server", "dns.example"}, "example.com", "json", "tcp-tls", "dns.example:853"},
+	}
+	for _, test := range tests {
+		for i := range app.Commands {
+			if app.Commands[i].Name != "a" {
+				continue
+			}
+			var host, format string
+			var client *dnsClient
+			app.Commands[i].Action = func(c *cli.Context) error {
+				host, format = c.String("host"), c.String("output")
+				var err error
+				client, err = newDNSClient(c)
+				return err
+			}
+			if err := app.Run(append([]string{"cli", "a"}, test.args...)); err != nil {
+				t.Errorf("%v: %v", test.args, err)
+				continue
+			}
+			if host != test.host || format != test.format || client.transport != test.transport || client.server != test.server ||
+				client.timeout != 3*time.Second || client.retries != 0 {
+				t.Errorf("%v: unexpected %s %s %+v", test.args, host, format, client)
+			}
+		}
+	}
+
+	// The shared flag slices keep their defaults.
+	for _, f := range lookupFlags {
+		if sf, ok := f.(cli.StringFlag); ok && sf.Name == "host" && sf.Value != "tutorialedge.net" {
+			t.Errorf("the config changed the shared host default to %q", sf.Value)
+		}
+	}
+}
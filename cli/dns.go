@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+)
+
+// dnsClient sends raw DNS queries to one resolver. Unlike the net package
+// it can use any record type, any transport and returns TTLs and the SOA.
+type dnsClient struct {
+	// system is set by --system. Lookups then go through the operating
+	// system's resolver, which honours the hosts file and search domains,
+	// for every record type the net package can look up.
+	system bool
+	// transport is "udp" (or empty), "tcp", "tcp-tls" (DNS over TLS) or
+	// "https" (DNS over HTTPS).
+	transport string
+	// server is the resolver's host:port, or its URL for "https".
+	server  string
+	timeout time.Duration
+	// retries is how many times a query that got no answer (timeout,
+	// network error) is sent again.
+	retries int
+	// tlsConfig is used by "tcp-tls" and "https"; nil means the system
+	// roots.
+	tlsConfig *tls.Config
+	// cache, when set, answers queries whose TTLs haven't run out.
+	cache *dnsCache
+}
+
+// resolverFlags select the resolver of every lookup command.
+var resolverFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "server",
+		Usage: "resolver to query, e.g. 1.1.1.1 or, with --doh, https://dns.google/dns-query (default: the first nameserver of /etc/resolv.conf)",
+	},
+	cli.IntFlag{
+		Name:  "port",
+		Usage: "resolver port (default: 53, 853 with --dot, 443 with --doh)",
+	},
+	cli.BoolFlag{Name: "tcp", Usage: "query over TCP"},
+	cli.BoolFlag{Name: "dot", Usage: "query over DNS-over-TLS"},
+	cli.BoolFlag{Name: "doh", Usage: "query over DNS-over-HTTPS"},
+	cli.BoolFlag{Name: "system", Usage: "look up through the operating system's resolver, which reads the hosts file and search domains but reports no TTLs and isn't cached"},
+	cli.DurationFlag{Name: "timeout", Value: 5 * time.Second, Usage: "timeout of each attempt"},
+	cli.IntFlag{Name: "retries", Value: 2, Usage: "attempts after the first one when the resolver doesn't answer"},
+	cli.BoolFlag{Name: "no-cache", Usage: "always ask the resolver instead of the on-disk cache of answers"},
+}
+
+// resolvConf is where systemServer finds the nameservers.
+var resolvConf = "/etc/resolv.conf"
+
+// systemServer returns the first nameserver of resolvConf.
+func systemServer() (host, port string) {
+	conf, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil || len(conf.Servers) == 0 {
+		return "127.0.0.1", "53"
+	}
+	return conf.Servers[0], conf.Port
+}
+
+// newDNSClient builds the client selected by the resolver flags.
+func newDNSClient(c *cli.Context) (*dnsClient, error) {
+	dc := &dnsClient{transport: "udp", timeout: c.Duration("timeout"), retries: c.Int("retries")}
+	if !c.Bool("no-cache") {
+		dc.cache = newDNSCache()
+	}
+	if dc.timeout <= 0 {
+		dc.timeout = 5 * time.Second
+	}
+	if dc.retries < 0 {
+		dc.retries = 0
+	}
+	// The config file can turn one transport on by default; one given on
+	// the command line replaces it.
+	explicit := 0
+	for _, name := range []string{"tcp", "dot", "doh", "system"} {
+		if c.IsSet(name) && c.Bool(name) {
+			explicit++
+		}
+	}
+	if explicit > 1 {
+		return nil, usageError{errors.New("--tcp, --dot, --doh and --system are mutually exclusive")}
+	}
+	on := func(name string) bool {
+		return c.Bool(name) && (explicit == 0 || c.IsSet(name))
+	}
+
+	server, port := c.String("server"), ""
+	if on("system") {
+		if c.IsSet("server") {
+			return nil, usageError{errors.New("--system can't be combined with --server")}
+		}
+		// Record types the net package can't look up still go to the
+		// first nameserver.
+		dc.system, server = true, ""
+	}
+	if p := c.Int("port"); p != 0 {
+		port = strconv.Itoa(p)
+	}
+
+	if on("doh") {
+		if server == "" {
+			return nil, usageError{errors.New("--doh needs --server")}
+		}
+		dc.transport = "https"
+		if strings.HasPrefix(server, "https://") {
+			dc.server = server
+			return dc, nil
+		}
+		host := server
+		if port != "" {
+			host = net.JoinHostPort(server, port)
+		} else if strings.Contains(server, ":") {
+			host = "[" + server + "]"
+		}
+		dc.server = "https://" + host + "/dns-query"
+		return dc, nil
+	}
+
+	defaultPort := "53"
+	switch {
+	case on("dot"):
+		if server == "" {
+			return nil, usageError{errors.New("--dot needs --server")}
+		}
+		dc.transport, defaultPort = "tcp-tls", "853"
+	case on("tcp"):
+		dc.transport = "tcp"
+	}
+	if server == "" {
+		server, defaultPort = systemServer()
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	dc.server = net.JoinHostPort(server, port)
+	return dc, nil
+}
+
+// query asks for the records of type qtype at name and returns the answers
+// of that type; CNAMEs followed on the way are dropped unless asked for.
+// NXDOMAIN and other failures are errors, an empty answer is not.
+func (c *dnsClient) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+
+	var path string
+	var resp *dns.Msg
+	if c.cache != nil {
+		path = c.cache.path(c.transport, c.server, m.Question[0].Name, qtype)
+		resp = c.cache.get(path)
+	}
+	if resp == nil {
+		var err error
+		if resp, err = c.exchange(ctx, m); err != nil {
+			return nil, fmt.Errorf("lookup %s on %s: %w", name, c.server, err)
+		}
+		if c.cache != nil {
+			c.cache.put(path, resp)
+		}
+	}
+	if err := rcodeError(name, resp.Rcode); err != nil {
+		return nil, err
+	}
+
+	var answers []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype {
+			answers = append(answers, rr)
+		}
+	}
+	return answers, nil
+}
+
+// exchange sends m, retrying when no answer comes back.
+func (c *dnsClient) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		var resp *dns.Msg
+		if resp, err = c.exchangeOnce(ctx, m); err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (c *dnsClient) exchangeOnce(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if c.transport == "https" {
+		return c.exchangeHTTPS(ctx, m)
+	}
+	client := &dns.Client{Net: c.transport, Timeout: c.timeout}
+	if c.transport == "tcp-tls" {
+		client.TLSConfig = c.tls(c.server)
+	}
+	resp, _, err := client.ExchangeContext(ctx, m, c.server)
+	if err == nil && resp.Truncated && (c.transport == "" || c.transport == "udp") {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, m, c.server)
+	}
+	return resp, err
+}
+
+// exchangeHTTPS posts m as an RFC 8484 DNS-over-HTTPS request.
+func (c *dnsClient) exchangeHTTPS(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	q := m.Copy()
+	// RFC 8484 asks for ID 0 so responses are cache friendly.
+	q.Id = 0
+	body, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: c.tls(req.URL.Host)}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server answered %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	answer := new(dns.Msg)
+	if err := answer.Unpack(data); err != nil {
+		return nil, err
+	}
+	answer.Id = m.Id
+	return answer, nil
+}
+
+// tls returns the TLS configuration for a server given as host:port.
+func (c *dnsClient) tls(server string) *tls.Config {
+	cfg := &tls.Config{}
+	if c.tlsConfig != nil {
+		cfg = c.tlsConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			host = server
+		}
+		cfg.ServerName = host
+	}
+	return cfg
+}
+
+// errNoSuchHost is wrapped by the errors of lookups that got NXDOMAIN.
+var errNoSuchHost = errors.New("no such host (NXDOMAIN)")
+
+func rcodeError(name string, rcode int) error {
+	switch rcode {
+	case dns.RcodeSuccess:
+		return nil
+	case dns.RcodeNameError:
+		return fmt.Errorf("lookup %s: %w", name, errNoSuchHost)
+	default:
+		return fmt.Errorf("lookup %s: %s", name, dns.RcodeToString[rcode])
+	}
+}
+
+// rrRecord converts an answer to a record, with the record data in the
+// presentation format dig prints.
+func rrRecord(rr dns.RR) record {
+	h := rr.Header()
+	return record{
+		Name:  h.Name,
+		TTL:   h.Ttl,
+		Type:  dns.TypeToString[h.Rrtype],
+		Value: strings.TrimPrefix(rr.String(), h.String()),
+	}
+}
+
+// recordLookup is a lookupFunc for one record type.
+func recordLookup(qtype uint16) lookupFunc {
+	return func(ctx context.Context, c *dnsClient, host string) ([]record, error) {
+		if lookup, ok := systemLookups[qtype]; ok && c.system {
+			ctx, cancel := c.systemContext(ctx)
+			defer cancel()
+			return lookup(ctx, host)
+		}
+		answers, err := c.query(ctx, host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]record, len(answers))
+		for i, rr := range answers {
+			records[i] = rrRecord(rr)
+		}
+		return records, nil
+	}
+}
+
+// lookupIP resolves both the IPv4 and IPv6 addresses of host.
+func lookupIP(ctx context.Context, c *dnsClient, host string) ([]record, error) {
+	if c.system {
+		ctx, cancel := c.systemContext(ctx)
+		defer cancel()
+		return systemIP(ctx, host, "ip")
+	}
+	v4, err := recordLookup(dns.TypeA)(ctx, c, host)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := recordLookup(dns.TypeAAAA)(ctx, c, host)
+	if err != nil {
+		return nil, err
+	}
+	return append(v4, v6...), nil
+}
+
+// lookupPTR resolves the names of an IP address.
+func lookupPTR(ctx context.Context, c *dnsClient, addr string) ([]record, error) {
+	arpa, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("ptr needs an IP address: %w", err)
+	}
+	if c.system {
+		ctx, cancel := c.systemContext(ctx)
+		defer cancel()
+		names, err := net.DefaultResolver.LookupAddr(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]record, len(names))
+		for i, name := range names {
+			records[i] = record{Name: arpa, Type: "PTR", Value: name}
+		}
+		return records, nil
+	}
+	return recordLookup(dns.TypePTR)(ctx, c, arpa)
+}
+
+// systemContext bounds a lookup through the system resolver by the
+// timeout. The resolver makes its own attempts, so there are no retries.
+func (c *dnsClient) systemContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// systemLookups look up the record types the net package has a function
+// for through the system resolver. It doesn't report TTLs, and a name
+// without records of the type fails like a missing one.
+var systemLookups = map[uint16]func(ctx context.Context, host string) ([]record, error){
+	dns.TypeA: func(ctx context.Context, host string) ([]record, error) {
+		return systemIP(ctx, host, "ip4")
+	},
+	dns.TypeAAAA: func(ctx context.Context, host string) ([]record, error) {
+		return systemIP(ctx, host, "ip6")
+	},
+	dns.TypeNS: func(ctx context.Context, host string) ([]record, error) {
+		ns, err := net.DefaultResolver.LookupNS(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]record, len(ns))
+		for i, n := range ns {
+			records[i] = record{Name: dns.Fqdn(host), Type: "NS", Value: n.Host}
+		}
+		return records, nil
+	},
+	dns.TypeCNAME: func(ctx context.Context, host string) ([]record, error) {
+		cname, err := net.DefaultResolver.LookupCNAME(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		// A name that isn't an alias is its own canonical name.
+		if strings.EqualFold(cname, dns.Fqdn(host)) {
+			return nil, nil
+		}
+		return []record{{Name: dns.Fqdn(host), Type: "CNAME", Value: cname}}, nil
+	},
+	dns.TypeMX: func(ctx context.Context, host string) ([]record, error) {
+		mx, err := net.DefaultResolver.LookupMX(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]record, len(mx))
+		for i, m := range mx {
+			records[i] = record{Name: dns.Fqdn(host), Type: "MX", Value: fmt.Sprintf("%d %s", m.Pref, m.Host)}
+		}
+		return records, nil
+	},
+	dns.TypeTXT: func(ctx context.Context, host string) ([]record, error) {
+		txt, err := net.DefaultResolver.LookupTXT(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]record, len(txt))
+		for i, t := range txt {
+			records[i] = record{Name: dns.Fqdn(host), Type: "TXT", Value: strconv.Quote(t)}
+		}
+		return records, nil
+	},
+	dns.TypeSRV: func(ctx context.Context, host string) ([]record, error) {
+		_, srv, err := net.DefaultResolver.LookupSRV(ctx, "", "", host)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]record, len(srv))
+		for i, s := range srv {
+			records[i] = record{Name: dns.Fqdn(host), Type: "SRV", Value: fmt.Sprintf("%d %d %d %s", s.Priority, s.Weight, s.Port, s.Target)}
+		}
+		return records, nil
+	},
+}
+
+// systemIP resolves the addresses of host for network "ip", "ip4" or
+// "ip6" through the system resolver.
+func systemIP(ctx context.Context, host, network string) ([]record, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]record, len(ips))
+	for i, ip := range ips {
+		typ := "AAAA"
+		if ip.To4() != nil {
+			typ = "A"
+		}
+		records[i] = record{Name: dns.Fqdn(host), Type: typ, Value: ip.String()}
+	}
+	return records, nil
+}
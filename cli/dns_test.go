@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+)
+
+// startDNS serves zone (records in zone file syntax) on a local UDP and TCP
+// port and returns the address. Names missing from the zone get NXDOMAIN;
+// UDP answers over 512 bytes are truncated so clients retry over TCP.
+func startDNS(t *testing.T, zone ...string) string {
+	t.Helper()
+	return startDNSOn(t, "127.0.0.1:0", zone...)
+}
+
+// startDNSOn is startDNS on a given address.
+func startDNSOn(t *testing.T, addr string, zone ...string) string {
+	t.Helper()
+	var rrs []dns.RR
+	for _, line := range zone {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Authoritative = true
+		q := req.Question[0]
+		known := false
+		for _, rr := range rrs {
+			if !strings.EqualFold(rr.Header().Name, q.Name) {
+				continue
+			}
+			known = true
+			if rr.Header().Rrtype == q.Qtype {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+		if !known {
+			resp.Rcode = dns.RcodeNameError
+		}
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && resp.Len() > dns.MinMsgSize {
+			resp.Answer = nil
+			resp.Truncated = true
+		}
+		w.WriteMsg(resp)
+	})
+
+	var pc net.PacketConn
+	var ln net.Listener
+	for attempt := 0; ; attempt++ {
+		var err error
+		if pc, err = net.ListenPacket("udp", addr); err != nil {
+			t.Fatal(err)
+		}
+		if ln, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+		// The TCP side of a random UDP port can be taken; pick another.
+		if !strings.HasSuffix(addr, ":0") || attempt == 10 {
+			t.Fatal(err)
+		}
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: ln, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+var testZone = []string{
+	"example.com. 300 IN A 192.0.2.1",
+	"example.com. 300 IN AAAA 2001:db8::1",
+	`example.com. 300 IN TXT "v=spf1 -all"`,
+	"example.com. 3600 IN SOA ns1.example.com. admin.example.com. 2024010101 7200 900 1209600 300",
+	`example.com. 300 IN CAA 0 issue "letsencrypt.org"`,
+	"_sip._tcp.example.com. 300 IN SRV 10 60 5060 sip.example.com.",
+	"1.2.0.192.in-addr.arpa. 300 IN PTR example.com.",
+	`big.example.com. 300 IN TXT "` + strings.Repeat("a", 250) + `"`,
+	`big.example.com. 300 IN TXT "` + strings.Repeat("b", 250) + `"`,
+	`big.example.com. 300 IN TXT "` + strings.Repeat("c", 250) + `"`,
+}
+
+func TestRawLookups(t *testing.T) {
+	c := &dnsClient{server: startDNS(t, testZone...), timeout: 2 * time.Second}
+
+	var tests = []struct {
+		lookup lookupFunc
+		host   string
+		want   []string
+	}{
+		{recordLookup(dns.TypeA), "example.com", []string{"192.0.2.1"}},
+		{recordLookup(dns.TypeAAAA), "example.com", []string{"2001:db8::1"}},
+		{recordLookup(dns.TypeTXT), "example.com", []string{`"v=spf1 -all"`}},
+		{recordLookup(dns.TypeSRV), "_sip._tcp.example.com", []string{"10 60 5060 sip.example.com."}},
+		{recordLookup(dns.TypeSOA), "example.com", []string{"ns1.example.com. admin.example.com. 2024010101 7200 900 1209600 300"}},
+		{recordLookup(dns.TypeCAA), "example.com", []string{`0 issue "letsencrypt.org"`}},
+		{lookupPTR, "192.0.2.1", []string{"example.com."}},
+		{recordLookup(dns.TypeMX), "example.com", nil},
+		{recordLookup(dns.TypeTXT), "big.example.com", []string{`"` + strings.Repeat("a", 250) + `"`, `"` + strings.Repeat("b", 250) + `"`, `"` + strings.Repeat("c", 250) + `"`}},
+	}
+	for _, test := range tests {
+		records, err := test.lookup(context.Background(), c, test.host)
+		if err != nil {
+			t.Errorf("%s: %v", test.host, err)
+			continue
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.Value)
+		}
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: expected %q, got %q", test.host, test.want, got)
+		}
+	}
+}
+
+func TestRawLookupErrors(t *testing.T) {
+	c := &dnsClient{server: startDNS(t, testZone...), timeout: 2 * time.Second}
+	if _, err := recordLookup(dns.TypeA)(context.Background(), c, "missing.example.com"); err == nil || !strings.Contains(err.Error(), "NXDOMAIN") {
+		t.Errorf("expected NXDOMAIN, got %v", err)
+	}
+	if _, err := lookupPTR(context.Background(), c, "not-an-ip"); err == nil {
+		t.Error("expected an error for a PTR lookup of a name")
+	}
+
+	// Nothing listens on the address.
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	dead := pc.LocalAddr().String()
+	pc.Close()
+	c = &dnsClient{server: dead, timeout: 200 * time.Millisecond}
+	if _, err := recordLookup(dns.TypeA)(context.Background(), c, "example.com"); err == nil {
+		t.Error("expected an error without a server")
+	}
+}
+
+// testTLS returns a server certificate for 127.0.0.1 and a client config
+// trusting it.
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	return srv.TLS, &tls.Config{RootCAs: roots}
+}
+
+func TestTransports(t *testing.T) {
+	upstream := startDNS(t, testZone...)
+	serverTLS, clientTLS := testTLS(t)
+
+	// DNS over TLS in front of the test server.
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp, err := dns.Exchange(req, upstream)
+		if err != nil {
+			return
+		}
+		w.WriteMsg(resp)
+	})}
+	go dot.ActivateAndServe()
+	defer dot.Shutdown()
+
+	// DNS over HTTPS in front of the test server.
+	doh := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" || req.Unpack(body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp, err := dns.Exchange(req, upstream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		data, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(data)
+	}))
+	doh.TLS = serverTLS
+	doh.StartTLS()
+	defer doh.Close()
+
+	var tests = []struct {
+		transport string
+		server    string
+	}{
+		{"udp", upstream},
+		{"tcp", upstream},
+		{"tcp-tls", ln.Addr().String()},
+		{"https", doh.URL + "/dns-query"},
+	}
+	for _, test := range tests {
+		c := &dnsClient{transport: test.transport, server: test.server, timeout: 2 * time.Second, tlsConfig: clientTLS}
+		records, err := recordLookup(dns.TypeA)(context.Background(), c, "example.com")
+		if err != nil {
+			t.Errorf("%s: %v", test.transport, err)
+			continue
+		}
+		if len(records) != 1 || records[0].Value != "192.0.2.1" {
+			t.Errorf("%s: unexpected records %v", test.transport, records)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	// The server ignores the first two queries.
+	var mu sync.Mutex
+	queries := 0
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		queries++
+		n := queries
+		mu.Unlock()
+		if n <= 2 {
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	for _, test := range []struct {
+		retries int
+		ok      bool
+	}{{1, false}, {2, true}} {
+		mu.Lock()
+		queries = 0
+		mu.Unlock()
+		c := &dnsClient{server: pc.LocalAddr().String(), timeout: 100 * time.Millisecond, retries: test.retries}
+		_, err := recordLookup(dns.TypeA)(context.Background(), c, "example.com")
+		if (err == nil) != test.ok {
+			t.Errorf("retries=%d: expected ok=%v, got %v", test.retries, test.ok, err)
+		}
+	}
+}
+
+func TestResolverFlags(t *testing.T) {
+	var tests = []struct {
+		args      []string
+		transport string
+		server    string
+		err       bool
+	}{
+		{[]string{"--server", "192.0.2.53"}, "udp", "192.0.2.53:53", false},
+		{[]string{"--server", "192.0.2.53", "--port", "5353", "--tcp"}, "tcp", "192.0.2.53:5353", false},
+		{[]string{"--server", "2001:db8::53", "--tcp"}, "tcp", "[2001:db8::53]:53", false},
+		{[]string{"--server", "dns.example", "--dot"}, "tcp-tls", "dns.example:853", false},
+		{[]string{"--server", "dns.example", "--doh"}, "https", "https://dns.example/dns-query", false},
+		{[]string{"--server", "2001:db8::53", "--doh"}, "https", "https://[2001:db8::53]/dns-query", false},
+		{[]string{"--server", "https://dns.example/q", "--doh"}, "https", "https://dns.example/q", false},
+		{[]string{"--dot"}, "", "", true},
+		{[]string{"--doh"}, "", "", true},
+		{[]string{"--server", "x", "--tcp", "--dot"}, "", "", true},
+		{[]string{"--system", "--tcp"}, "", "", true},
+		{[]string{"--system", "--server", "x"}, "", "", true},
+	}
+	for _, test := range tests {
+		var got *dnsClient
+		var err error
+		app := cli.NewApp()
+		app.Flags = resolverFlags
+		app.Action = func(c *cli.Context) error {
+			got, err = newDNSClient(c)
+			return nil
+		}
+		app.Run(append([]string{"cli"}, test.args...))
+		if test.err {
+			if err == nil || exitCode(err) != 2 {
+				t.Errorf("%v: expected a usage error, got %v", test.args, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.args, err)
+			continue
+		}
+		if got.transport != test.transport || got.server != test.server {
+			t.Errorf("%v: expected %s %s, got %s %s", test.args, test.transport, test.server, got.transport, got.server)
+		}
+	}
+}
+
+func TestSystemResolver(t *testing.T) {
+	for _, test := range []struct {
+		args   []string
+		system bool
+	}{
+		{nil, false},
+		{[]string{"--system"}, true},
+		{[]string{"--server", "192.0.2.53"}, false},
+		{[]string{"--tcp"}, false},
+	} {
+		var got *dnsClient
+		app := cli.NewApp()
+		app.Flags = resolverFlags
+		app.Action = func(c *cli.Context) (err error) {
+			got, err = newDNSClient(c)
+			return err
+		}
+		if err := app.Run(append([]string{"cli"}, test.args...)); err != nil {
+			t.Fatal(err)
+		}
+		if got.system != test.system {
+			t.Errorf("%v: expected system=%v, got %v", test.args, test.system, got.system)
+		}
+	}
+
+	// localhost comes from the hosts file, which only the system resolver
+	// reads. It reports no TTLs.
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ip", "--system", "localhost"}, "127.0.0.1\n"},
+		{[]string{"a", "--system", "-o", "table", "localhost"}, "localhost.  -    A     127.0.0.1\n"},
+	} {
+		app := newApp()
+		var out strings.Builder
+		app.Writer = &out
+		if err := app.Run(append([]string{"cli"}, test.args...)); err != nil {
+			t.Errorf("%v: %v", test.args, err)
+			continue
+		}
+		if !strings.Contains(out.String(), test.want) || strings.Contains(out.String(), "(TTL") {
+			t.Errorf("%v: expected %q, got\n%s", test.args, test.want, out.String())
+		}
+	}
+}
+
+func TestDefaultResolver(t *testing.T) {
+	// Without --server the first nameserver of resolv.conf is queried
+	// directly, so TTLs are reported and answers cached.
+	var queries atomic.Int32
+	upstream := startDNS(t, testZone...)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		if resp, err := dns.Exchange(req, upstream); err == nil {
+			w.WriteMsg(resp)
+		}
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+
+	conf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(conf, []byte("nameserver 127.0.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { resolvConf = path }(resolvConf)
+	resolvConf = conf
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	for i := 0; i < 2; i++ {
+		app := newApp()
+		var out strings.Builder
+		app.Writer = &out
+		if err := app.Run([]string{"cli", "a", "--port", port, "example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(out.String(), "192.0.2.1 (TTL ") {
+			t.Errorf("expected the address with its TTL, got %q", out.String())
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("expected the second lookup from the cache, got %d queries", n)
+	}
+}
@@ -1,10 +1,18 @@
 module github.com/alexandreafj/golang-study/cli
 
-go 1.19
+go 1.25.0
+
+require (
+	github.com/miekg/dns v1.1.73
+	github.com/urfave/cli v1.22.10
+	golang.org/x/term v0.45.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
 	github.com/russross/blackfriday/v2 v2.0.1 // indirect
 	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
-	github.com/urfave/cli v1.22.10 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
 )
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// record is one DNS record in presentation format: Value holds the record
+// data the way dig prints it, e.g. "10 mail.example.com." for MX. TTL is
+// in seconds, what is left of it when the answer came from a cache, and 0
+// when unknown: --system doesn't report it.
+type record struct {
+	Name  string `json:"name" yaml:"name"`
+	TTL   uint32 `json:"ttl" yaml:"ttl"`
+	Type  string `json:"type" yaml:"type"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// result is what every lookup command prints.
+type result struct {
+	Host    string   `json:"host" yaml:"host"`
+	Type    string   `json:"type" yaml:"type"`
+	Records []record `json:"records" yaml:"records"`
+	Error   string   `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// lookupFunc resolves the records of one type for host through c.
+type lookupFunc func(ctx context.Context, c *dnsClient, host string) ([]record, error)
+
+// lookupType is one record lookup: the command name, its usage line and
+// the record type reported in results.
+type lookupType struct {
+	name   string
+	usage  string
+	typ    string
+	lookup lookupFunc
+}
+
+func findLookup(name string) (lookupType, bool) {
+	for _, lt := range lookupTypes {
+		if lt.name == name {
+			return lt, true
+		}
+	}
+	return lookupType{}, false
+}
+
+// lookupFlags are shared by all lookup commands.
+var lookupFlags = append([]cli.Flag{
+	cli.StringFlag{
+		Name:  "host",
+		Value: "tutorialedge.net",
+		Usage: "host to look up (a positional argument works too)",
+	},
+	cli.StringFlag{
+		Name:  "output, o",
+		Value: "text",
+		Usage: "output format: " + strings.Join(outputFormats, ", "),
+	},
+}, resolverFlags...)
+
+// lookupCommand builds the command that runs lt and prints the result in
+// the chosen format. A failed lookup is still printed in the structured
+// formats, then returned so the process exits non-zero. With --watch the
+// lookup repeats until interrupted.
+func lookupCommand(lt lookupType) cli.Command {
+	return cli.Command{
+		Name:      lt.name,
+		Usage:     lt.usage,
+		ArgsUsage: "[host]",
+		Flags:     append(append([]cli.Flag{}, lookupFlags...), watchFlags...),
+		Action: func(c *cli.Context) error {
+			format := c.String("output")
+			if !validFormat(format) {
+				return usageError{fmt.Errorf("unknown output format %q (want one of %s)", format, strings.Join(outputFormats, ", "))}
+			}
+			interval := c.Duration("watch")
+			if interval < 0 || interval == 0 && (c.String("on-change") != "" || c.String("webhook") != "") {
+				return usageError{errors.New("--on-change and --webhook need a positive --watch interval")}
+			}
+			client, err := newDNSClient(c)
+			if err != nil {
+				return err
+			}
+			if interval > 0 {
+				// A watch is there to see changes the cache would hide.
+				client.cache = nil
+			}
+			host := c.String("host")
+			if c.NArg() > 0 {
+				host = c.Args().First()
+			}
+
+			lookup := func(ctx context.Context) result {
+				res := result{Host: host, Type: lt.typ, Records: []record{}}
+				records, err := lt.lookup(ctx, client, host)
+				if records != nil {
+					res.Records = records
+				}
+				if err != nil {
+					res.Error = err.Error()
+				}
+				return res
+			}
+
+			if interval > 0 {
+				ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+				defer stop()
+				w := &watcher{
+					interval:   interval,
+					format:     format,
+					out:        c.App.Writer,
+					color:      isTerminal(c.App.Writer),
+					hook:       c.String("on-change"),
+					webhook:    c.String("webhook"),
+					httpClient: &http.Client{Timeout: 10 * time.Second},
+					now:        time.Now,
+				}
+				return w.run(ctx, lookup)
+			}
+
+			res := lookup(context.Background())
+			if res.Error != "" {
+				err = errors.New(res.Error)
+				if format == "text" || format == "table" {
+					return err
+				}
+			}
+			if perr := printResult(c.App.Writer, format, res); perr != nil {
+				return perr
+			}
+			return err
+		},
+	}
+}
+
+// usageError marks errors in the command line itself, which exit with 2
+// instead of 1.
+type usageError struct {
+	error
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func fakeLookup(ctx context.Context, _ *dnsClient, host string) ([]record, error) {
+	if host == "missing.example" {
+		return nil, errors.New("no such host")
+	}
+	return []record{
+		{Name: host, TTL: 300, Type: "MX", Value: "10 mx1." + host + "."},
+		{Name: host, TTL: 60, Type: "MX", Value: "20 mx2." + host + "."},
+	}, nil
+}
+
+func runLookup(args ...string) (string, error) {
+	app := cli.NewApp()
+	app.Commands = []cli.Command{lookupCommand(lookupType{"mx", "", "MX", fakeLookup})}
+	var out bytes.Buffer
+	app.Writer = &out
+	err := app.Run(append([]string{"cli", "mx"}, args...))
+	return out.String(), err
+}
+
+func TestLookupOutput(t *testing.T) {
+	var tests = []struct {
+		args []string
+		want string
+	}{
+		{nil, "10 mx1.tutorialedge.net. (TTL 300)\n20 mx2.tutorialedge.net. (TTL 60)\n"},
+		{[]string{"--host", "example.com"}, "10 mx1.example.com. (TTL 300)\n20 mx2.example.com. (TTL 60)\n"},
+		{[]string{"example.com"}, "10 mx1.example.com. (TTL 300)\n20 mx2.example.com. (TTL 60)\n"},
+		{[]string{"-o", "table", "example.com"}, "NAME         TTL  TYPE  VALUE\nexample.com  300  MX    10 mx1.example.com.\nexample.com  60   MX    20 mx2.example.com.\n"},
+		{[]string{"-o", "json", "example.com"}, `"ttl": 300,`},
+		{[]string{"-o", "yaml", "example.com"}, "host: example.com\ntype: MX\nrecords:\n  - name: example.com\n    ttl: 300\n    type: MX\n    value: 10 mx1.example.com.\n"},
+	}
+	for _, test := range tests {
+		out, err := runLookup(test.args...)
+		if err != nil {
+			t.Errorf("%v: %v", test.args, err)
+			continue
+		}
+		if !strings.Contains(out, test.want) {
+			t.Errorf("%v: expected %q in\n%s", test.args, test.want, out)
+		}
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	var tests = []struct {
+		args []string
+		code int
+		out  string
+	}{
+		{[]string{"missing.example"}, 1, ""},
+		{[]string{"-o", "json", "missing.example"}, 1, `"error": "no such host"`},
+		{[]string{"-o", "xml", "example.com"}, 2, ""},
+	}
+	for _, test := range tests {
+		out, err := runLookup(test.args...)
+		if err == nil {
+			t.Errorf("%v: expected an error", test.args)
+			continue
+		}
+		if code := exitCode(err); code != test.code {
+			t.Errorf("%v: expected exit code %d, got %d", test.args, test.code, code)
+		}
+		if !strings.Contains(out, test.out) {
+			t.Errorf("%v: expected %q in\n%s", test.args, test.out, out)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+)
+
+// auditCheck is one check of a mail audit. A pass earns all its points, a
+// warning half of them and a failure none.
+type auditCheck struct {
+	Name      string `json:"name" yaml:"name"`
+	Status    string `json:"status" yaml:"status"`
+	Points    int    `json:"points" yaml:"points"`
+	MaxPoints int    `json:"max_points" yaml:"max_points"`
+	Detail    string `json:"detail" yaml:"detail"`
+}
+
+const (
+	auditPass = "pass"
+	auditWarn = "warn"
+	auditFail = "fail"
+)
+
+// auditReport is what the mail-audit command prints.
+type auditReport struct {
+	Domain   string       `json:"domain" yaml:"domain"`
+	Score    int          `json:"score" yaml:"score"`
+	MaxScore int          `json:"max_score" yaml:"max_score"`
+	Checks   []auditCheck `json:"checks" yaml:"checks"`
+}
+
+// failed returns how many checks failed.
+func (r auditReport) failed() int {
+	n := 0
+	for _, c := range r.Checks {
+		if c.Status == auditFail {
+			n++
+		}
+	}
+	return n
+}
+
+// mailAuditor checks how well a domain is set up to receive and
+// authenticate mail.
+type mailAuditor struct {
+	client *dnsClient
+	// smtpPort is where the MX hosts are expected to greet.
+	smtpPort    string
+	smtpTimeout time.Duration
+	// selectors are the DKIM selectors tried; they can't be listed, only
+	// guessed or known.
+	selectors []string
+	// mtaSTSURL is the MTA-STS policy URL with %s for the domain.
+	mtaSTSURL  string
+	httpClient *http.Client
+}
+
+// auditChecks are the checks in report order, with their points.
+var auditChecks = []struct {
+	name   string
+	points int
+	run    func(a *mailAuditor, ctx context.Context, domain string) (status, detail string)
+}{
+	{"mx", 30, (*mailAuditor).checkMX},
+	{"spf", 20, (*mailAuditor).checkSPF},
+	{"dmarc", 20, (*mailAuditor).checkDMARC},
+	{"dkim", 15, (*mailAuditor).checkDKIM},
+	{"mta-sts", 15, (*mailAuditor).checkMTASTS},
+}
+
+func (a *mailAuditor) audit(ctx context.Context, domain string) auditReport {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	report := auditReport{Domain: domain, Checks: []auditCheck{}}
+	for _, ac := range auditChecks {
+		status, detail := ac.run(a, ctx, domain)
+		c := auditCheck{Name: ac.name, Status: status, MaxPoints: ac.points, Detail: detail}
+		switch status {
+		case auditPass:
+			c.Points = ac.points
+		case auditWarn:
+			c.Points = ac.points / 2
+		}
+		report.Score += c.Points
+		report.MaxScore += c.MaxPoints
+		report.Checks = append(report.Checks, c)
+	}
+	return report
+}
+
+// txtRecords returns the TXT records of name, each one's strings joined.
+// A name that doesn't exist has no records rather than an error.
+func (a *mailAuditor) txtRecords(ctx context.Context, name string) ([]string, error) {
+	answers, err := a.client.query(ctx, name, dns.TypeTXT)
+	if errors.Is(err, errNoSuchHost) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	txts := make([]string, len(answers))
+	for i, rr := range answers {
+		txts[i] = strings.Join(rr.(*dns.TXT).Txt, "")
+	}
+	return txts, nil
+}
+
+// withPrefix returns the records starting with prefix, case-insensitively.
+func withPrefix(txts []string, prefix string) []string {
+	var matching []string
+	for _, txt := range txts {
+		if len(txt) >= len(prefix) && strings.EqualFold(txt[:len(prefix)], prefix) {
+			matching = append(matching, txt)
+		}
+	}
+	return matching
+}
+
+// tags parses "k=v; k=v" records like DMARC and DKIM.
+func tags(record string) map[string]string {
+	m := make(map[string]string)
+	for _, part := range strings.Split(record, ";") {
+		k, v, ok := strings.Cut(part, "=")
+		if ok {
+			m[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	return m
+}
+
+// checkMX passes when every MX host greets with a 220 banner.
+func (a *mailAuditor) checkMX(ctx context.Context, domain string) (string, string) {
+	answers, err := a.client.query(ctx, domain, dns.TypeMX)
+	if err != nil {
+		return auditFail, err.Error()
+	}
+	if len(answers) == 0 {
+		return auditFail, "no MX records"
+	}
+	var details []string
+	reachable := 0
+	for _, rr := range answers {
+		mx := rr.(*dns.MX)
+		if mx.Mx == "." {
+			return auditFail, "null MX: the domain accepts no mail"
+		}
+		banner, err := a.smtpBanner(ctx, mx.Mx)
+		if err != nil {
+			details = append(details, fmt.Sprintf("%s: %v", mx.Mx, err))
+			continue
+		}
+		reachable++
+		details = append(details, fmt.Sprintf("%s: %s", mx.Mx, banner))
+	}
+	detail := fmt.Sprintf("%d of %d MX hosts answer (%s)", reachable, len(answers), strings.Join(details, "; "))
+	switch reachable {
+	case len(answers):
+		return auditPass, detail
+	case 0:
+		return auditFail, detail
+	default:
+		return auditWarn, detail
+	}
+}
+
+// smtpBanner connects to host's SMTP port and returns its greeting.
+func (a *mailAuditor) smtpBanner(ctx context.Context, host string) (string, error) {
+	addrs, err := a.client.query(ctx, host, dns.TypeA)
+	if err == nil && len(addrs) == 0 {
+		addrs, err = a.client.query(ctx, host, dns.TypeAAAA)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", errors.New("no address")
+	}
+	var ip string
+	switch rr := addrs[0].(type) {
+	case *dns.A:
+		ip = rr.A.String()
+	case *dns.AAAA:
+		ip = rr.AAAA.String()
+	}
+
+	d := net.Dialer{Timeout: a.smtpTimeout}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, a.smtpPort))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(a.smtpTimeout))
+
+	tp := textproto.NewConn(conn)
+	_, msg, err := tp.ReadResponse(220)
+	if err != nil {
+		return "", fmt.Errorf("bad greeting: %w", err)
+	}
+	tp.PrintfLine("QUIT")
+	return "220 " + strings.SplitN(msg, "\n", 2)[0], nil
+}
+
+// checkSPF passes for a single SPF record that ends in -all or ~all.
+func (a *mailAuditor) checkSPF(ctx context.Context, domain string) (string, string) {
+	txts, err := a.txtRecords(ctx, domain)
+	if err != nil {
+		return auditFail, err.Error()
+	}
+	spf := withPrefix(txts, "v=spf1")
+	switch {
+	case len(spf) == 0:
+		return auditFail, "no SPF record"
+	case len(spf) > 1:
+		return auditFail, fmt.Sprintf("%d SPF records, receivers treat that as an error", len(spf))
+	}
+	record := spf[0]
+	for _, term := range strings.Fields(record)[1:] {
+		switch strings.ToLower(term) {
+		case "-all", "~all":
+			return auditPass, record
+		case "?all":
+			return auditWarn, "?all leaves other senders neutral: " + record
+		case "+all", "all":
+			return auditFail, "+all lets anyone send as the domain: " + record
+		}
+		if strings.HasPrefix(strings.ToLower(term), "redirect=") {
+			return auditPass, record
+		}
+	}
+	return auditWarn, "no all mechanism, other senders are neutral: " + record
+}
+
+// checkDMARC passes for a DMARC policy that quarantines or rejects.
+func (a *mailAuditor) checkDMARC(ctx context.Context, domain string) (string, string) {
+	txts, err := a.txtRecords(ctx, "_dmarc."+domain)
+	if err != nil {
+		return auditFail, err.Error()
+	}
+	dmarc := withPrefix(txts, "v=DMARC1")
+	switch {
+	case len(dmarc) == 0:
+		return auditFail, "no DMARC record at _dmarc." + domain
+	case len(dmarc) > 1:
+		return auditFail, fmt.Sprintf("%d DMARC records, receivers ignore them all", len(dmarc))
+	}
+	record := dmarc[0]
+	switch strings.ToLower(tags(record)["p"]) {
+	case "reject", "quarantine":
+		return auditPass, record
+	case "none":
+		return auditWarn, "p=none only monitors: " + record
+	default:
+		return auditFail, "missing or invalid policy: " + record
+	}
+}
+
+// checkDKIM looks for a public key under each known selector.
+func (a *mailAuditor) checkDKIM(ctx context.Context, domain string) (string, string) {
+	var found []string
+	for _, selector := range a.selectors {
+		txts, err := a.txtRecords(ctx, selector+"._domainkey."+domain)
+		if err != nil {
+			return auditFail, err.Error()
+		}
+		for _, txt := range txts {
+			// An empty p= is a revoked key.
+			if tags(txt)["p"] != "" {
+				found = append(found, selector)
+				break
+			}
+		}
+	}
+	if len(found) == 0 {
+		// Selectors can't be listed, so a miss may be a selector we
+		// didn't try.
+		return auditWarn, "no DKIM key for the selectors " + strings.Join(a.selectors, ", ")
+	}
+	return auditPass, "keys for the selectors " + strings.Join(found, ", ")
+}
+
+// checkMTASTS passes when the domain publishes an enforced MTA-STS policy.
+func (a *mailAuditor) checkMTASTS(ctx context.Context, domain string) (string, string) {
+	txts, err := a.txtRecords(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return auditFail, err.Error()
+	}
+	if len(withPrefix(txts, "v=STSv1")) == 0 {
+		return auditFail, "no MTA-STS record at _mta-sts." + domain
+	}
+
+	url := fmt.Sprintf(a.mtaSTSURL, domain)
+	ctx, cancel := context.WithTimeout(ctx, a.smtpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return auditFail, err.Error()
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return auditFail, "policy: " + err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return auditFail, fmt.Sprintf("policy %s: %s", url, resp.Status)
+	}
+
+	policy := make(map[string]string)
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 64<<10))
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), ":"); ok {
+			policy[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	if policy["version"] != "STSv1" {
+		return auditFail, "policy " + url + " is not an STSv1 policy"
+	}
+	switch mode := policy["mode"]; mode {
+	case "enforce":
+		return auditPass, "mode enforce"
+	case "testing":
+		return auditWarn, "mode testing only reports failures"
+	default:
+		return auditFail, fmt.Sprintf("mode %q", mode)
+	}
+}
+
+func mailAuditCommand() cli.Command {
+	return cli.Command{
+		Name:      "mail-audit",
+		Usage:     "Audits the mail setup of a domain: MX reachability, SPF, DMARC, DKIM and MTA-STS",
+		ArgsUsage: "[domain]",
+		Flags: append(append([]cli.Flag{}, lookupFlags...),
+			cli.IntFlag{Name: "smtp-port", Value: 25, Usage: "port the MX hosts are expected to answer SMTP on"},
+			cli.DurationFlag{Name: "smtp-timeout", Value: 10 * time.Second, Usage: "timeout of each SMTP and MTA-STS connection"},
+			cli.StringFlag{Name: "dkim-selectors", Value: "default,google,selector1,selector2,k1,dkim", Usage: "comma separated DKIM selectors to look for"},
+		),
+		Action: func(c *cli.Context) error {
+			format := c.String("output")
+			if !validFormat(format) {
+				return usageError{fmt.Errorf("unknown output format %q (want one of %s)", format, strings.Join(outputFormats, ", "))}
+			}
+			client, err := newDNSClient(c)
+			if err != nil {
+				return err
+			}
+			// An audit checks the records as published, often right after
+			// fixing them.
+			client.cache = nil
+			domain := c.String("host")
+			if c.NArg() > 0 {
+				domain = c.Args().First()
+			}
+
+			a := &mailAuditor{
+				client:      client,
+				smtpPort:    fmt.Sprint(c.Int("smtp-port")),
+				smtpTimeout: c.Duration("smtp-timeout"),
+				mtaSTSURL:   "https://mta-sts.%s/.well-known/mta-sts.txt",
+				httpClient:  &http.Client{},
+			}
+			for _, s := range strings.Split(c.String("dkim-selectors"), ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					a.selectors = append(a.selectors, s)
+				}
+			}
+
+			report := a.audit(context.Background(), domain)
+			switch format {
+			case "json", "yaml":
+				err = printValue(c.App.Writer, format, report)
+			default:
+				err = printAudit(c.App.Writer, report, format == "table")
+			}
+			if err != nil {
+				return err
+			}
+			if n := report.failed(); n > 0 {
+				return fmt.Errorf("%d of %d mail checks failed for %s", n, len(report.Checks), report.Domain)
+			}
+			return nil
+		},
+	}
+}
+
+// printAudit prints the score, then a line per check; table adds a
+// header.
+func printAudit(w io.Writer, report auditReport, header bool) error {
+	fmt.Fprintf(w, "mail audit of %s: %d/%d\n", report.Domain, report.Score, report.MaxScore)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if header {
+		fmt.Fprintln(tw, "STATUS\tCHECK\tPOINTS\tDETAIL")
+	}
+	for _, c := range report.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\n", strings.ToUpper(c.Status), c.Name, c.Points, c.MaxPoints, c.Detail)
+	}
+	return tw.Flush()
+}
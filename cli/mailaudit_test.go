@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// startSMTP accepts connections and greets them with banner.
+func startSMTP(t *testing.T, banner string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "%s\r\n", banner)
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+// goodMailZone is example. set up for every check; mx2 is 127.0.0.2, where
+// no SMTP server listens.
+var goodMailZone = []string{
+	"example. 300 IN MX 10 mx1.example.",
+	"mx1.example. 300 IN A 127.0.0.1",
+	"mx2.example. 300 IN A 127.0.0.2",
+	`example. 300 IN TXT "v=spf1 mx -all"`,
+	`example. 300 IN TXT "google-site-verification=abc"`,
+	`_dmarc.example. 300 IN TXT "v=DMARC1; p=reject; rua=mailto:dmarc@example"`,
+	`selector1._domainkey.example. 300 IN TXT "v=DKIM1; k=rsa; p=MIGfMA0GCSq" "GSIb3DQEBAQUAA4GNADCBiQKBgQC"`,
+	`_mta-sts.example. 300 IN TXT "v=STSv1; id=20240101"`,
+}
+
+func newTestAuditor(t *testing.T, smtpPort, mode string, zone ...string) *mailAuditor {
+	sts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/example/.well-known/mta-sts.txt" || mode == "" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "version: STSv1\r\nmode: %s\r\nmx: mx1.example\r\nmax_age: 86400\r\n", mode)
+	}))
+	t.Cleanup(sts.Close)
+	return &mailAuditor{
+		client:      &dnsClient{server: startDNS(t, zone...), timeout: time.Second},
+		smtpPort:    smtpPort,
+		smtpTimeout: time.Second,
+		selectors:   []string{"default", "selector1"},
+		mtaSTSURL:   sts.URL + "/%s/.well-known/mta-sts.txt",
+		httpClient:  sts.Client(),
+	}
+}
+
+// replace returns zone with the records of name and type replaced by rrs.
+func replace(zone []string, prefix string, rrs ...string) []string {
+	var out []string
+	for _, rr := range zone {
+		if !strings.HasPrefix(rr, prefix) {
+			out = append(out, rr)
+		}
+	}
+	return append(out, rrs...)
+}
+
+func TestMailAudit(t *testing.T) {
+	port := startSMTP(t, "220 mx1.example ESMTP ready")
+	badPort := startSMTP(t, "554 go away")
+
+	var tests = []struct {
+		name   string
+		zone   []string
+		port   string
+		mode   string
+		score  int
+		status string // of every check, in order
+	}{
+		{"good", goodMailZone, port, "enforce", 100, "pass pass pass pass pass"},
+		{"one MX down", append(goodMailZone, "example. 300 IN MX 20 mx2.example."), port, "enforce", 85, "warn pass pass pass pass"},
+		{"bad banner", goodMailZone, badPort, "enforce", 70, "fail pass pass pass pass"},
+		{"soft", replace(replace(goodMailZone, `example. 300 IN TXT "v=spf1`, `example. 300 IN TXT "v=spf1 mx ?all"`),
+			"_dmarc", `_dmarc.example. 300 IN TXT "v=DMARC1; p=none"`), port, "testing", 72, "pass warn warn pass warn"},
+		{"two SPF records", append(goodMailZone, `example. 300 IN TXT "v=spf1 +all"`), port, "enforce", 80, "pass fail pass pass pass"},
+		{"nothing", []string{"example. 300 IN A 192.0.2.1"}, port, "", 7, "fail fail fail warn fail"},
+		{"null MX", replace(goodMailZone, "example. 300 IN MX", "example. 300 IN MX 0 ."), port, "enforce", 70, "fail pass pass pass pass"},
+		{"revoked DKIM key", replace(goodMailZone, "selector1", `selector1._domainkey.example. 300 IN TXT "v=DKIM1; p="`), port, "enforce", 92, "pass pass pass warn pass"},
+		{"no policy", goodMailZone, port, "", 85, "pass pass pass pass fail"},
+	}
+	for _, test := range tests {
+		a := newTestAuditor(t, test.port, test.mode, test.zone...)
+		report := a.audit(context.Background(), "example.")
+		var statuses []string
+		for _, c := range report.Checks {
+			statuses = append(statuses, c.Status)
+		}
+		if got := strings.Join(statuses, " "); got != test.status || report.Score != test.score || report.MaxScore != 100 {
+			t.Errorf("%s: expected %s scoring %d, got %s scoring %d/%d: %+v", test.name, test.status, test.score, got, report.Score, report.MaxScore, report.Checks)
+		}
+	}
+}
+
+func TestMailAuditCommand(t *testing.T) {
+	port := startSMTP(t, "220 mx1.example ESMTP ready")
+	resolver := startDNS(t, goodMailZone...)
+	host, dnsPort, _ := net.SplitHostPort(resolver)
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{mailAuditCommand()}
+	var out bytes.Buffer
+	app.Writer = &out
+	// The MTA-STS policy can't be fetched from mta-sts.example, so that
+	// check fails and so does the command.
+	err := app.Run([]string{"cli", "mail-audit", "--server", host, "--port", dnsPort, "--smtp-port", port, "--smtp-timeout", "500ms", "example"})
+	if err == nil || exitCode(err) != 1 || !strings.Contains(err.Error(), "1 of 5") {
+		t.Errorf("expected the MTA-STS check to fail, got %v", err)
+	}
+	for _, want := range []string{"mail audit of example: 85/100", "PASS  mx       30/30", "FAIL  mta-sts  0/15"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in\n%s", want, out.String())
+		}
+	}
+}
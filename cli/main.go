@@ -1,98 +1,75 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"net"
 	"os"
 
+	"github.com/miekg/dns"
 	"github.com/urfave/cli"
 )
 
-func main() {
-    app := cli.NewApp()
-    app.Name = "Website Lookup CLI"
-    app.Usage = "Let's you query IPs, CNAMEs, MX records and Name Servers!"
+func newApp() *cli.App {
+	app := cli.NewApp()
+	app.Name = "Website Lookup CLI"
+	app.Usage = "Let's you query IPs, CNAMEs, MX, TXT, SRV, PTR, SOA and CAA records and Name Servers!"
+	app.EnableBashCompletion = true
+
+	// we create one command per record lookup, all sharing the same
+	// flags, plus batch mode over all of them, the iterative trace, the
+	// name server consistency check, the mail audit, the interactive shell,
+	// the management of the answer cache and the generated docs
+	for _, lt := range lookupTypes {
+		app.Commands = append(app.Commands, lookupCommand(lt))
+	}
+	app.Commands = append(app.Commands, batchCommand(), traceCommand(), checkCommand(), mailAuditCommand(), shellCommand(), cacheCommand(),
+		completionCommand(), manCommand())
+	return app
+}
 
-    // We'll be using the same flag for all our commands
-    // so we'll define it up here
-    myFlags := []cli.Flag{
-        cli.StringFlag{
-            Name:  "host",
-            Value: "tutorialedge.net",
-        },
-    }
+// lookupTypes are the record lookups, each available as a command and in
+// batch mode.
+var lookupTypes = []lookupType{
+	{"ns", "Looks Up the NameServers for a Particular Host", "NS", recordLookup(dns.TypeNS)},
+	{"ip", "Looks up the IP addresses for a particular host", "IP", lookupIP},
+	{"cname", "Looks up the CNAME for a particular host", "CNAME", recordLookup(dns.TypeCNAME)},
+	{"mx", "Looks up the MX records for a particular host", "MX", recordLookup(dns.TypeMX)},
+	{"a", "Looks up the IPv4 addresses of a particular host", "A", recordLookup(dns.TypeA)},
+	{"aaaa", "Looks up the IPv6 addresses of a particular host", "AAAA", recordLookup(dns.TypeAAAA)},
+	{"txt", "Looks up the TXT records of a particular host", "TXT", recordLookup(dns.TypeTXT)},
+	{"srv", "Looks up SRV records, e.g. _sip._tcp.example.com", "SRV", recordLookup(dns.TypeSRV)},
+	{"ptr", "Looks up the host names of an IP address (reverse lookup)", "PTR", lookupPTR},
+	{"soa", "Looks up the SOA record of a zone", "SOA", recordLookup(dns.TypeSOA)},
+	{"caa", "Looks up the CAA records (allowed certificate authorities) of a host", "CAA", recordLookup(dns.TypeCAA)},
+}
+
+func main() {
+	app := newApp()
+	// the user's config file replaces the flag defaults
+	path, err := userConfigPath()
+	if err == nil {
+		cfg, err := loadUserConfig(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(2)
+		}
+		if cfg != nil {
+			cfg.apply(app.Commands)
+		}
+	}
 
-    // we create our commands
-    app.Commands = []cli.Command{
-        {
-            Name:  "ns",
-            Usage: "Looks Up the NameServers for a Particular Host",
-            Flags: myFlags,
-            // the action, or code that will be executed when
-            // we execute our `ns` command
-            Action: func(c *cli.Context) error {
-                // a simple lookup function
-                ns, err := net.LookupNS(c.String("url"))
-                if err != nil {
-                    return err
-                }
-                // we log the results to our console
-                // using a trusty fmt.Println statement
-                for i := 0; i < len(ns); i++ {
-                    fmt.Println(ns[i].Host)
-                }
-                return nil
-            },
-        },
-		{
-			Name:  "ip",
-			Usage: "Looks up the IP addresses for a particular host",
-			Flags: myFlags,
-			Action: func(c *cli.Context) error {
-				ip, err := net.LookupIP(c.String("host"))
-				if err != nil {
-					fmt.Println(err)
-				}
-				for i := 0; i < len(ip); i++ {
-					fmt.Println(ip[i])
-				}
-				return nil
-			},
-		},
-		{
-			Name:  "cname",
-			Usage: "Looks up the CNAME for a particular host",
-			Flags: myFlags,
-			Action: func(c *cli.Context) error {
-				cname, err := net.LookupCNAME(c.String("host"))
-				if err != nil {
-					fmt.Println(err)
-				}
-				fmt.Println(cname)
-				return nil
-			},
-		},
-		{
-			Name:  "mx",
-			Usage: "Looks up the MX records for a particular host",
-			Flags: myFlags,
-			Action: func(c *cli.Context) error {
-				mx, err := net.LookupMX(c.String("host"))
-				if err != nil {
-					fmt.Println(err)
-				}
-				for i := 0; i < len(mx); i++ {
-					fmt.Println(mx[i].Host, mx[i].Pref)
-				}
-				return nil
-			},
-		},
-    }
+	// start our application
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(exitCode(err))
+	}
+}
 
-    // start our application
-    err := app.Run(os.Args)
-    if err != nil {
-        log.Fatal(err)
-    }
-}
\ No newline at end of file
+// exitCode is 2 for a bad command line and 1 for a failed lookup.
+func exitCode(err error) int {
+	var usage usageError
+	if errors.As(err, &usage) {
+		return 2
+	}
+	return 1
+}
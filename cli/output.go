@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+var outputFormats = []string{"text", "json", "yaml", "table"}
+
+func validFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// printResult writes res to w. text prints one record value per line with
+// its TTL, if known; table adds the name and type columns.
+func printResult(w io.Writer, format string, res result) error {
+	switch format {
+	case "json", "yaml":
+		return printValue(w, format, res)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTTL\tTYPE\tVALUE")
+		for _, r := range res.Records {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Name, formatTTL(r.TTL), r.Type, r.Value)
+		}
+		return tw.Flush()
+	default:
+		for _, r := range res.Records {
+			line := r.Value
+			if r.TTL > 0 {
+				line += fmt.Sprintf(" (TTL %d)", r.TTL)
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// printValue writes v as indented JSON or YAML.
+func printValue(w io.Writer, format string, v interface{}) error {
+	if format == "yaml" {
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// formatTTL prints an unknown TTL as "-".
+func formatTTL(ttl uint32) string {
+	if ttl == 0 {
+		return "-"
+	}
+	return strconv.FormatUint(uint64(ttl), 10)
+}
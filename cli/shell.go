@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+	"golang.org/x/term"
+)
+
+// shell runs lookups typed at a prompt. It keeps a default host for the
+// session and remembers the hosts queried so far for tab completion.
+type shell struct {
+	client *dnsClient
+	host   string
+	format string
+	out    io.Writer
+	// hosts are the hosts queried so far, oldest first.
+	hosts   []string
+	history []string
+}
+
+// shellBuiltins are the shell's own commands besides the lookups.
+var shellBuiltins = []string{"host", "output", "history", "help", "exit", "quit"}
+
+func shellCommand() cli.Command {
+	return cli.Command{
+		Name:  "shell",
+		Usage: "Starts an interactive prompt for running lookups against a session default host",
+		Flags: lookupFlags,
+		Action: func(c *cli.Context) error {
+			format := c.String("output")
+			if !validFormat(format) {
+				return usageError{fmt.Errorf("unknown output format %q (want one of %s)", format, strings.Join(outputFormats, ", "))}
+			}
+			client, err := newDNSClient(c)
+			if err != nil {
+				return err
+			}
+			// Repeating a lookup at the prompt should ask again.
+			client.cache = nil
+			s := &shell{client: client, host: c.String("host"), format: format, out: c.App.Writer}
+
+			fd := int(os.Stdin.Fd())
+			if !term.IsTerminal(fd) {
+				return s.run(os.Stdin)
+			}
+			state, err := term.MakeRaw(fd)
+			if err != nil {
+				return err
+			}
+			defer term.Restore(fd, state)
+			return s.runTerminal(term.NewTerminal(struct {
+				io.Reader
+				io.Writer
+			}{os.Stdin, os.Stdout}, "dns> "))
+		},
+	}
+}
+
+// run executes the lines of r without a prompt, for scripts and pipes.
+func (s *shell) run(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if s.exec(scanner.Text()) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// runTerminal reads lines with editing, history on the arrow keys and tab
+// completion until exit or end of input.
+func (s *shell) runTerminal(t *term.Terminal) error {
+	s.out = t
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return s.complete(line, pos)
+	}
+	fmt.Fprintf(t, "default host %s; type help for the commands\n", s.host)
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if s.exec(line) {
+			return nil
+		}
+	}
+}
+
+// exec runs one line and reports whether the shell should exit. Errors are
+// printed, never fatal.
+func (s *shell) exec(line string) (exit bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	s.history = append(s.history, strings.TrimSpace(line))
+
+	name, args := fields[0], fields[1:]
+	switch name {
+	case "exit", "quit":
+		return true
+	case "help":
+		s.help()
+	case "history":
+		for i, h := range s.history {
+			fmt.Fprintf(s.out, "%4d  %s\n", i+1, h)
+		}
+	case "host":
+		if len(args) > 0 {
+			s.host = args[0]
+			s.remember(s.host)
+		}
+		fmt.Fprintln(s.out, "default host:", s.host)
+	case "output":
+		if len(args) > 0 {
+			if !validFormat(args[0]) {
+				fmt.Fprintf(s.out, "error: unknown output format %q (want one of %s)\n", args[0], strings.Join(outputFormats, ", "))
+				return false
+			}
+			s.format = args[0]
+		}
+		fmt.Fprintln(s.out, "output:", s.format)
+	default:
+		lt, ok := findLookup(name)
+		if !ok {
+			fmt.Fprintf(s.out, "error: unknown command %q, type help for the commands\n", name)
+			return false
+		}
+		host := s.host
+		if len(args) > 0 {
+			host = args[0]
+		}
+		s.remember(host)
+		s.lookup(lt, host)
+	}
+	return false
+}
+
+func (s *shell) lookup(lt lookupType, host string) {
+	res := result{Host: host, Type: lt.typ, Records: []record{}}
+	records, err := lt.lookup(context.Background(), s.client, host)
+	if records != nil {
+		res.Records = records
+	}
+	if err != nil {
+		res.Error = err.Error()
+		if s.format == "text" || s.format == "table" {
+			fmt.Fprintln(s.out, "error:", err)
+			return
+		}
+	}
+	if err := printResult(s.out, s.format, res); err != nil {
+		fmt.Fprintln(s.out, "error:", err)
+	}
+}
+
+// remember adds host to the completion candidates, most recent last.
+func (s *shell) remember(host string) {
+	for i, h := range s.hosts {
+		if h == host {
+			s.hosts = append(s.hosts[:i], s.hosts[i+1:]...)
+			break
+		}
+	}
+	s.hosts = append(s.hosts, host)
+}
+
+func (s *shell) help() {
+	fmt.Fprintln(s.out, "lookups, on the default host unless one is given:")
+	for _, lt := range lookupTypes {
+		fmt.Fprintf(s.out, "  %-6s [host]  %s\n", lt.name, lt.usage)
+	}
+	fmt.Fprintln(s.out, "  host [host]     show or set the default host")
+	fmt.Fprintln(s.out, "  output [format] show or set the output format: "+strings.Join(outputFormats, ", "))
+	fmt.Fprintln(s.out, "  history         list the commands of this session")
+	fmt.Fprintln(s.out, "  exit            leave the shell")
+}
+
+// complete completes the word before pos: a command name first, then a
+// previously queried host. Several candidates complete to their common
+// prefix.
+func (s *shell) complete(line string, pos int) (string, int, bool) {
+	before := line[:pos]
+	start := strings.LastIndexAny(before, " \t") + 1
+	word := before[start:]
+
+	var candidates []string
+	switch strings.TrimSpace(before[:start]) {
+	case "":
+		for _, lt := range lookupTypes {
+			candidates = append(candidates, lt.name)
+		}
+		candidates = append(candidates, shellBuiltins...)
+	case "output":
+		candidates = outputFormats
+	default:
+		candidates = s.hosts
+	}
+
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(matches)
+	completion := matches[0]
+	if len(matches) == 1 {
+		completion += " "
+	} else {
+		for _, m := range matches[1:] {
+			for !strings.HasPrefix(m, completion) {
+				completion = completion[:len(completion)-1]
+			}
+		}
+	}
+	if completion == word {
+		return "", 0, false
+	}
+	return before[:start] + completion + line[pos:], start + len(completion), true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/term"
+)
+
+func newTestShell(t *testing.T) (*shell, *bytes.Buffer) {
+	var out bytes.Buffer
+	client := &dnsClient{server: startDNS(t, testZone...), timeout: time.Second}
+	return &shell{client: client, host: "example.com", format: "text", out: &out}, &out
+}
+
+func TestShellExec(t *testing.T) {
+	s, out := newTestShell(t)
+	err := s.run(strings.NewReader(strings.Join([]string{
+		"a",
+		"txt example.com",
+		"",
+		"host big.example.com",
+		"aaaa",
+		"output json",
+		"a missing.example.com",
+		"output csv",
+		"bogus",
+		"history",
+		"exit",
+		"a",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"192.0.2.1 (TTL 300)\n\"v=spf1 -all\" (TTL 300)\n",
+		"default host: big.example.com\n",
+		"output: json\n",
+		`"error": "lookup missing.example.com: no such host (NXDOMAIN)"`,
+		`error: unknown output format "csv"`,
+		`error: unknown command "bogus"`,
+		"   4  aaaa\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in\n%s", want, out.String())
+		}
+	}
+	if strings.Count(out.String(), "192.0.2.1") != 1 {
+		t.Errorf("the lookup after exit ran:\n%s", out.String())
+	}
+	if s.host != "big.example.com" || strings.Join(s.hosts, " ") != "example.com big.example.com missing.example.com" {
+		t.Errorf("unexpected session state: %q %q", s.host, s.hosts)
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	s := &shell{hosts: []string{"example.com", "example.org", "tutorialedge.net"}}
+	var tests = []struct {
+		line string
+		pos  int
+		want string
+		ok   bool
+	}{
+		{"m", 1, "mx ", true},
+		{"ca", 2, "caa ", true},
+		{"c", 1, "", false},
+		{"cn", 2, "cname ", true},
+		{"a", 1, "", false},
+		{"mx t", 4, "mx tutorialedge.net ", true},
+		{"mx ex", 5, "mx example.", true},
+		{"host exam", 9, "host example.", true},
+		{"output y", 8, "output yaml ", true},
+		{"mx z", 4, "", false},
+		{"n tail", 1, "ns  tail", true},
+	}
+	for _, test := range tests {
+		got, pos, ok := s.complete(test.line, test.pos)
+		if ok != test.ok || got != test.want {
+			t.Errorf("%q: expected %q %v, got %q %v", test.line, test.want, test.ok, got, ok)
+		}
+		if ok && pos > len(got) {
+			t.Errorf("%q: cursor %d past the line %q", test.line, pos, got)
+		}
+	}
+}
+
+func TestShellTerminal(t *testing.T) {
+	s, _ := newTestShell(t)
+	var out bytes.Buffer
+	// A tab completes "tx", the up arrow repeats the line.
+	in := strings.NewReader("host example.com\rtx\t\r\x1b[A\r")
+	tm := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{in, &out}, "dns> ")
+	if err := s.runTerminal(tm); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out.String(), `"v=spf1 -all"`); n != 2 {
+		t.Errorf("expected the TXT record twice, got %d in\n%q", n, out.String())
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+)
+
+// rootHints are the IPv4 addresses of the root servers.
+var rootHints = []nameServer{
+	{"a.root-servers.net.", "198.41.0.4"},
+	{"b.root-servers.net.", "170.247.170.2"},
+	{"c.root-servers.net.", "192.33.4.12"},
+	{"d.root-servers.net.", "199.7.91.13"},
+	{"e.root-servers.net.", "192.203.230.10"},
+	{"f.root-servers.net.", "192.5.5.241"},
+	{"g.root-servers.net.", "192.112.36.4"},
+	{"h.root-servers.net.", "198.97.190.53"},
+	{"i.root-servers.net.", "192.36.148.17"},
+	{"j.root-servers.net.", "192.58.128.30"},
+	{"k.root-servers.net.", "193.0.14.129"},
+	{"l.root-servers.net.", "199.7.83.42"},
+	{"m.root-servers.net.", "202.12.27.33"},
+}
+
+type nameServer struct {
+	name string
+	addr string
+}
+
+// traceStep is one query of a trace: which server was asked about which
+// zone, how long it took and what came back (the answer or the
+// delegation).
+type traceStep struct {
+	Zone      string   `json:"zone" yaml:"zone"`
+	Server    string   `json:"server" yaml:"server"`
+	Address   string   `json:"address" yaml:"address"`
+	LatencyMS float64  `json:"latency_ms" yaml:"latency_ms"`
+	Rcode     string   `json:"rcode,omitempty" yaml:"rcode,omitempty"`
+	Records   []record `json:"records" yaml:"records"`
+	Error     string   `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// tracer resolves a name iteratively, like dig +trace: starting at the
+// roots it follows every referral itself instead of asking a recursive
+// resolver, so a broken delegation shows up at the step where it breaks.
+type tracer struct {
+	// client resolves name servers that come without glue, and sets the
+	// timeout, retries and transport of the trace queries.
+	client *dnsClient
+	roots  []nameServer
+	// port is where every server of the trace is asked.
+	port     string
+	maxSteps int
+}
+
+// errTraceTooLong stops traces that loop through referrals or CNAMEs.
+var errTraceTooLong = errors.New("trace: too many steps (referral or CNAME loop?)")
+
+// trace resolves name, calling step for every query it sends.
+func (t *tracer) trace(ctx context.Context, name string, qtype uint16, step func(traceStep)) error {
+	name = dns.Fqdn(name)
+	zone, servers := ".", t.roots
+	for n := 0; n < t.maxSteps; n++ {
+		resp, err := t.ask(ctx, zone, servers, name, qtype, step)
+		if err != nil {
+			return err
+		}
+		if err := rcodeError(name, resp.Rcode); err != nil {
+			return err
+		}
+
+		if len(resp.Answer) > 0 {
+			target := ""
+			for _, rr := range resp.Answer {
+				if rr.Header().Rrtype == qtype {
+					return nil
+				}
+				if cname, ok := rr.(*dns.CNAME); ok {
+					target = cname.Target
+				}
+			}
+			if target == "" {
+				return nil
+			}
+			// Follow the alias from the roots, as a resolver would.
+			name, zone, servers = target, ".", t.roots
+			continue
+		}
+
+		child, next := t.referral(ctx, zone, resp)
+		if child == "" {
+			if !resp.Authoritative {
+				return fmt.Errorf("trace: servers of %s neither answer for %s nor delegate it (lame delegation)", zone, name)
+			}
+			// The name exists but has no records of this type.
+			return nil
+		}
+		if len(next) == 0 {
+			return fmt.Errorf("trace: no address for any name server of %s", child)
+		}
+		zone, servers = child, next
+	}
+	return errTraceTooLong
+}
+
+// ask queries the servers of zone in turn until one answers, reporting
+// every attempt.
+func (t *tracer) ask(ctx context.Context, zone string, servers []nameServer, name string, qtype uint16, step func(traceStep)) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+
+	transport := "udp"
+	if t.client.transport == "tcp" {
+		transport = "tcp"
+	}
+	client := &dns.Client{Net: transport, Timeout: t.client.timeout}
+	for _, ns := range servers {
+		addr := net.JoinHostPort(ns.addr, t.port)
+		s := traceStep{Zone: zone, Server: ns.name, Address: ns.addr, Records: []record{}}
+
+		start := time.Now()
+		resp, _, err := client.ExchangeContext(ctx, m, addr)
+		if err == nil && resp.Truncated && transport == "udp" {
+			tcp := &dns.Client{Net: "tcp", Timeout: t.client.timeout}
+			resp, _, err = tcp.ExchangeContext(ctx, m, addr)
+		}
+		s.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			s.Error = err.Error()
+			step(s)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		s.Rcode = dns.RcodeToString[resp.Rcode]
+		for _, rr := range append(resp.Answer, resp.Ns...) {
+			s.Records = append(s.Records, rrRecord(rr))
+		}
+		step(s)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("trace: no name server of %s answered", zone)
+}
+
+// referral returns the child zone and its name servers when resp delegates
+// below zone. Addresses come from the glue, or from the client's resolver
+// for name servers without glue.
+func (t *tracer) referral(ctx context.Context, zone string, resp *dns.Msg) (string, []nameServer) {
+	child := ""
+	var names []string
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		// A referral must lead down the tree; anything else is a lame
+		// or looping delegation.
+		if owner == zone || !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		child = owner
+		names = append(names, strings.ToLower(ns.Ns))
+	}
+	if child == "" {
+		return "", nil
+	}
+
+	glue := make(map[string][]string)
+	for _, rr := range resp.Extra {
+		if a, ok := rr.(*dns.A); ok {
+			name := strings.ToLower(a.Hdr.Name)
+			glue[name] = append(glue[name], a.A.String())
+		}
+	}
+	var servers []nameServer
+	for _, name := range names {
+		addrs := glue[name]
+		if len(addrs) == 0 {
+			if answers, err := t.client.query(ctx, name, dns.TypeA); err == nil {
+				for _, rr := range answers {
+					addrs = append(addrs, rr.(*dns.A).A.String())
+				}
+			}
+		}
+		for _, addr := range addrs {
+			servers = append(servers, nameServer{name, addr})
+		}
+	}
+	return child, servers
+}
+
+func traceCommand() cli.Command {
+	return cli.Command{
+		Name:      "trace",
+		Usage:     "Resolves a host iteratively from the root servers, printing every delegation step",
+		ArgsUsage: "[host]",
+		// The trace asks every server itself over UDP or TCP on port 53;
+		// the resolver flags only pick who finds name servers without glue,
+		// so the ones that change the trace's own queries are left out.
+		Flags: append(withoutFlags(lookupFlags, "port", "dot", "doh"),
+			cli.StringFlag{Name: "type, t", Value: "A", Usage: "record type to resolve, e.g. A, AAAA, MX"},
+			cli.StringFlag{Name: "root", Usage: "comma separated root server addresses to start from (default: the IANA root hints)"},
+		),
+		OnUsageError: func(c *cli.Context, err error, isSubcommand bool) error {
+			return usageError{err}
+		},
+		Action: func(c *cli.Context) error {
+			format := c.String("output")
+			if !validFormat(format) {
+				return usageError{fmt.Errorf("unknown output format %q (want one of %s)", format, strings.Join(outputFormats, ", "))}
+			}
+			qtype, ok := dns.StringToType[strings.ToUpper(c.String("type"))]
+			if !ok {
+				return usageError{fmt.Errorf("unknown record type %q", c.String("type"))}
+			}
+			client, err := newDNSClient(c)
+			if err != nil {
+				return err
+			}
+			host := c.String("host")
+			if c.NArg() > 0 {
+				host = c.Args().First()
+			}
+
+			t := &tracer{client: client, roots: rootHints, port: "53", maxSteps: 30}
+			if roots := c.String("root"); roots != "" {
+				t.roots = nil
+				for _, addr := range strings.Split(roots, ",") {
+					t.roots = append(t.roots, nameServer{name: addr, addr: strings.TrimSpace(addr)})
+				}
+			}
+
+			// Text streams the steps as they happen; the other formats
+			// need the whole trace.
+			var steps []traceStep
+			err = t.trace(context.Background(), host, qtype, func(s traceStep) {
+				if format == "text" {
+					printTraceStep(c.App.Writer, s)
+				} else {
+					steps = append(steps, s)
+				}
+			})
+			switch format {
+			case "table":
+				printTraceTable(c.App.Writer, steps)
+			case "json", "yaml":
+				res := struct {
+					Host  string      `json:"host" yaml:"host"`
+					Type  string      `json:"type" yaml:"type"`
+					Steps []traceStep `json:"steps" yaml:"steps"`
+					Error string      `json:"error,omitempty" yaml:"error,omitempty"`
+				}{Host: host, Type: dns.TypeToString[qtype], Steps: steps}
+				if err != nil {
+					res.Error = err.Error()
+				}
+				if perr := printValue(c.App.Writer, format, res); perr != nil {
+					return perr
+				}
+			}
+			return err
+		},
+	}
+}
+
+// withoutFlags returns a copy of flags without the named ones.
+func withoutFlags(flags []cli.Flag, names ...string) []cli.Flag {
+	var kept []cli.Flag
+next:
+	for _, f := range flags {
+		name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+		for _, n := range names {
+			if name == n {
+				continue next
+			}
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// printTraceStep prints a step the way dig +trace does: the records, then
+// where they came from.
+func printTraceStep(w io.Writer, s traceStep) {
+	if s.Error != "" {
+		fmt.Fprintf(w, ";; %s from %s (%s): %s\n\n", s.Zone, s.Server, s.Address, s.Error)
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+	for _, r := range s.Records {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", r.Name, r.TTL, r.Type, r.Value)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, ";; %s from %s (%s) in %.1fms: %s\n\n", s.Zone, s.Server, s.Address, s.LatencyMS, s.Rcode)
+}
+
+// printTraceTable prints one row per record of every step.
+func printTraceTable(w io.Writer, steps []traceStep) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ZONE\tSERVER\tLATENCY\tSTATUS\tNAME\tTTL\tTYPE\tVALUE")
+	for _, s := range steps {
+		status := s.Rcode
+		if s.Error != "" {
+			status = "error: " + s.Error
+		}
+		prefix := fmt.Sprintf("%s\t%s\t%.1fms\t%s", s.Zone, s.Address, s.LatencyMS, status)
+		if len(s.Records) == 0 {
+			fmt.Fprintf(tw, "%s\t\t\t\t\n", prefix)
+		}
+		for _, r := range s.Records {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", prefix, r.Name, r.TTL, r.Type, r.Value)
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/urfave/cli"
+)
+
+// startAuthority runs a fake name server on ip:port (UDP) answering with
+// zone, where delegations are NS records plus optional glue in extra.
+func startAuthority(t *testing.T, ip, port string, zone, extra []string) {
+	t.Helper()
+	parse := func(lines []string) []dns.RR {
+		var rrs []dns.RR
+		for _, line := range lines {
+			rr, err := dns.NewRR(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+	records, glue := parse(zone), parse(extra)
+
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", ip, err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		for _, rr := range records {
+			h := rr.Header()
+			switch {
+			case h.Rrtype == dns.TypeNS && dns.IsSubDomain(h.Name, q.Name) && h.Name != ".":
+				// A delegation of the name or one of its parents.
+				resp.Ns = append(resp.Ns, rr)
+			case strings.EqualFold(h.Name, q.Name) && (h.Rrtype == q.Qtype || h.Rrtype == dns.TypeCNAME):
+				resp.Answer = append(resp.Answer, rr)
+				resp.Authoritative = true
+			}
+		}
+		if len(resp.Answer) > 0 {
+			resp.Ns = nil
+		} else if len(resp.Ns) > 0 {
+			resp.Extra = glue
+		} else {
+			resp.Authoritative = true
+		}
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+}
+
+func startTraceHierarchy(t *testing.T) *tracer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+
+	// root -> example. -> sub.example. (without glue) and a lame
+	// delegation to a server that doesn't answer.
+	startAuthority(t, "127.0.0.1", port, []string{
+		"example. 172800 IN NS ns.example.",
+	}, []string{"ns.example. 172800 IN A 127.0.0.2"})
+	startAuthority(t, "127.0.0.2", port, []string{
+		"www.example. 300 IN A 192.0.2.10",
+		"alias.example. 300 IN CNAME www.example.",
+		"sub.example. 3600 IN NS ns.sub.example.",
+		"dead.example. 3600 IN NS ns.dead.example.",
+	}, []string{"ns.dead.example. 3600 IN A 127.0.0.4"})
+	startAuthority(t, "127.0.0.3", port, []string{
+		"host.sub.example. 300 IN A 192.0.2.20",
+	}, nil)
+
+	// The stub resolver finds the glueless name server.
+	stub := startDNS(t, "ns.sub.example. 300 IN A 127.0.0.3")
+	client := &dnsClient{server: stub, timeout: 200 * time.Millisecond}
+	return &tracer{client: client, roots: []nameServer{{"root.", "127.0.0.1"}}, port: port, maxSteps: 10}
+}
+
+func TestTrace(t *testing.T) {
+	tr := startTraceHierarchy(t)
+
+	var tests = []struct {
+		host  string
+		zones []string
+		final string
+		err   string
+	}{
+		{"www.example", []string{".", "example."}, "192.0.2.10", ""},
+		{"alias.example", []string{".", "example.", ".", "example."}, "192.0.2.10", ""},
+		{"host.sub.example", []string{".", "example.", "sub.example."}, "192.0.2.20", ""},
+		{"x.dead.example", []string{".", "example.", "dead.example."}, "", "no name server of dead.example. answered"},
+	}
+	for _, test := range tests {
+		var steps []traceStep
+		err := tr.trace(context.Background(), test.host, dns.TypeA, func(s traceStep) {
+			steps = append(steps, s)
+		})
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.host, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.host, err)
+			continue
+		}
+
+		var zones []string
+		for _, s := range steps {
+			zones = append(zones, s.Zone)
+		}
+		if strings.Join(zones, " ") != strings.Join(test.zones, " ") {
+			t.Errorf("%s: expected steps %v, got %v", test.host, test.zones, zones)
+		}
+		last := steps[len(steps)-1]
+		if test.final != "" && (len(last.Records) == 0 || last.Records[len(last.Records)-1].Value != test.final) {
+			t.Errorf("%s: expected %s in the last step, got %v", test.host, test.final, last.Records)
+		}
+		if test.err != "" && last.Error == "" {
+			t.Errorf("%s: the failing server is not reported: %+v", test.host, last)
+		}
+	}
+}
+
+func TestTraceCommandJSON(t *testing.T) {
+	app := cli.NewApp()
+	app.Commands = []cli.Command{traceCommand()}
+	var out bytes.Buffer
+	app.Writer = &out
+	// Nothing answers on port 53 of this root, so the trace stops there.
+	err := app.Run([]string{"cli", "trace", "-o", "json", "--timeout", "100ms", "--root", "127.0.0.9", "www.example"})
+	var res struct {
+		Steps []traceStep `json:"steps"`
+		Error string      `json:"error"`
+	}
+	if jerr := json.Unmarshal(out.Bytes(), &res); jerr != nil {
+		t.Fatalf("%v: %s", jerr, out.String())
+	}
+	if err == nil || res.Error == "" || len(res.Steps) != 1 || res.Steps[0].Address != "127.0.0.9" {
+		t.Errorf("expected one failed step, got %v %+v", err, res)
+	}
+}
+
+func TestTraceRejectsTransportFlags(t *testing.T) {
+	// The trace's own queries can't go over DoT or DoH, or to another
+	// port, so the flags that would ask for it are usage errors.
+	for _, flag := range []string{"--dot", "--doh", "--port=5353"} {
+		app := cli.NewApp()
+		app.Commands = []cli.Command{traceCommand()}
+		app.Writer, app.ErrWriter = io.Discard, io.Discard
+		err := app.Run([]string{"cli", "trace", flag, "--root", "127.0.0.9", "www.example"})
+		if exitCode(err) != 2 {
+			t.Errorf("%s: expected a usage error, got %v", flag, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"golang.org/x/term"
+)
+
+// watchFlags turn a lookup command into a monitor of the records.
+var watchFlags = []cli.Flag{
+	cli.DurationFlag{Name: "watch", Usage: "repeat the lookup at this interval, e.g. 30s, printing the records added and removed"},
+	cli.StringFlag{Name: "on-change", Usage: "with --watch, shell command run on every change; gets the change as JSON on stdin and in WATCH_* variables"},
+	cli.StringFlag{Name: "webhook", Usage: "with --watch, URL every change is POSTed to as JSON"},
+}
+
+// recordChange is a difference between two lookups of a watch.
+type recordChange struct {
+	Host    string    `json:"host" yaml:"host"`
+	Type    string    `json:"type" yaml:"type"`
+	Time    time.Time `json:"time" yaml:"time"`
+	Added   []record  `json:"added" yaml:"added"`
+	Removed []record  `json:"removed" yaml:"removed"`
+	Error   string    `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// diffRecords returns the records of next missing from prev and those of
+// prev missing from next. TTLs are ignored: a cache counts them down.
+func diffRecords(prev, next []record) (added, removed []record) {
+	in := func(rs []record, r record) bool {
+		for _, x := range rs {
+			if x.Name == r.Name && x.Type == r.Type && x.Value == r.Value {
+				return true
+			}
+		}
+		return false
+	}
+	added, removed = []record{}, []record{}
+	for _, r := range next {
+		if !in(prev, r) {
+			added = append(added, r)
+		}
+	}
+	for _, r := range prev {
+		if !in(next, r) {
+			removed = append(removed, r)
+		}
+	}
+	return added, removed
+}
+
+// watcher repeats a lookup and reports how its records change.
+type watcher struct {
+	interval time.Duration
+	format   string
+	out      io.Writer
+	// color highlights added records in green and removed ones in red.
+	color      bool
+	hook       string
+	webhook    string
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// run prints the first result, then every change, until ctx is done.
+func (w *watcher) run(ctx context.Context, lookup func(ctx context.Context) result) error {
+	prev := lookup(ctx)
+	if err := printResult(w.out, w.format, prev); err != nil {
+		return err
+	}
+	if prev.Error != "" && (w.format == "text" || w.format == "table") {
+		fmt.Fprintln(w.out, "error:", prev.Error)
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		next := lookup(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		added, removed := diffRecords(prev.Records, next.Records)
+		if len(added) == 0 && len(removed) == 0 && next.Error == prev.Error {
+			continue
+		}
+		change := recordChange{Host: next.Host, Type: next.Type, Time: w.now(), Added: added, Removed: removed, Error: next.Error}
+		prev = next
+		if err := w.print(change); err != nil {
+			return err
+		}
+		w.notify(ctx, change)
+	}
+}
+
+func (w *watcher) print(change recordChange) error {
+	if w.format == "json" || w.format == "yaml" {
+		return printValue(w.out, w.format, change)
+	}
+	fmt.Fprintf(w.out, "%s %s %s changed\n", change.Time.Format(time.RFC3339), change.Host, change.Type)
+	green, red, reset := "", "", ""
+	if w.color {
+		green, red, reset = "\x1b[32m", "\x1b[31m", "\x1b[0m"
+	}
+	for _, r := range change.Added {
+		fmt.Fprintf(w.out, "%s+ %s%s\n", green, r.Value, reset)
+	}
+	for _, r := range change.Removed {
+		fmt.Fprintf(w.out, "%s- %s%s\n", red, r.Value, reset)
+	}
+	if change.Error != "" {
+		fmt.Fprintln(w.out, "error:", change.Error)
+	}
+	return nil
+}
+
+// notify runs the hook and calls the webhook. Their failures are printed;
+// they don't stop the watch.
+func (w *watcher) notify(ctx context.Context, change recordChange) {
+	if w.hook == "" && w.webhook == "" {
+		return
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		fmt.Fprintln(w.out, "error:", err)
+		return
+	}
+
+	if w.hook != "" {
+		values := func(rs []record) string {
+			vs := make([]string, len(rs))
+			for i, r := range rs {
+				vs[i] = r.Value
+			}
+			return strings.Join(vs, "\n")
+		}
+		cmd := exec.CommandContext(ctx, "sh", "-c", w.hook)
+		cmd.Env = append(os.Environ(),
+			"WATCH_HOST="+change.Host,
+			"WATCH_TYPE="+change.Type,
+			"WATCH_ADDED="+values(change.Added),
+			"WATCH_REMOVED="+values(change.Removed),
+			"WATCH_ERROR="+change.Error,
+		)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Stdout, cmd.Stderr = w.out, w.out
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintln(w.out, "error: on-change hook:", err)
+		}
+	}
+
+	if w.webhook != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.webhook, bytes.NewReader(body))
+		if err != nil {
+			fmt.Fprintln(w.out, "error: webhook:", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := w.httpClient.Do(req)
+		if err != nil {
+			fmt.Fprintln(w.out, "error: webhook:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			fmt.Fprintln(w.out, "error: webhook answered", resp.Status)
+		}
+	}
+}
+
+// isTerminal reports whether w is a terminal, where changes are colored.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDiffRecords(t *testing.T) {
+	a := record{"example.com.", 300, "A", "192.0.2.1"}
+	b := record{"example.com.", 300, "A", "192.0.2.2"}
+	c := record{"example.com.", 300, "A", "192.0.2.3"}
+	older := record{"example.com.", 120, "A", "192.0.2.1"}
+	var tests = []struct {
+		prev, next     []record
+		added, removed []record
+	}{
+		{[]record{a, b}, []record{b, a}, nil, nil},
+		{[]record{a}, []record{a, b}, []record{b}, nil},
+		{[]record{a, b}, []record{c}, []record{c}, []record{a, b}},
+		{nil, []record{a}, []record{a}, nil},
+		{[]record{a, b}, []record{older, b}, nil, nil},
+	}
+	for _, test := range tests {
+		added, removed := diffRecords(test.prev, test.next)
+		if len(added) != len(test.added) || len(removed) != len(test.removed) {
+			t.Errorf("%v -> %v: expected +%v -%v, got +%v -%v", test.prev, test.next, test.added, test.removed, added, removed)
+			continue
+		}
+		for i := range added {
+			if added[i] != test.added[i] {
+				t.Errorf("%v -> %v: expected +%v, got +%v", test.prev, test.next, test.added, added)
+			}
+		}
+		for i := range removed {
+			if removed[i] != test.removed[i] {
+				t.Errorf("%v -> %v: expected -%v, got -%v", test.prev, test.next, test.removed, removed)
+			}
+		}
+	}
+}
+
+// sequence returns a lookup answering with each of values in turn, the
+// records of one result separated by commas, "!" for a failure. It cancels
+// the watch after the last one.
+func sequence(cancel context.CancelFunc, values ...string) func(context.Context) result {
+	n := 0
+	return func(ctx context.Context) result {
+		res := result{Host: "example.com", Type: "A", Records: []record{}}
+		if n == len(values) {
+			cancel()
+			return res
+		}
+		v := values[n]
+		n++
+		if v == "!" {
+			res.Error = "lookup example.com: timeout"
+			return res
+		}
+		for _, value := range strings.Split(v, ",") {
+			if value != "" {
+				res.Records = append(res.Records, record{"example.com.", 300, "A", value})
+			}
+		}
+		return res
+	}
+}
+
+func newTestWatcher(format string) (*watcher, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &watcher{
+		interval:   time.Millisecond,
+		format:     format,
+		out:        &out,
+		httpClient: http.DefaultClient,
+		now:        func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}, &out
+}
+
+func TestWatchText(t *testing.T) {
+	w, out := newTestWatcher("text")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := w.run(ctx, sequence(cancel, "192.0.2.1", "192.0.2.1", "192.0.2.1,192.0.2.2", "!", "!", "192.0.2.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "192.0.2.1 (TTL 300)\n" +
+		"2024-01-02T03:04:05Z example.com A changed\n+ 192.0.2.2\n" +
+		"2024-01-02T03:04:05Z example.com A changed\n- 192.0.2.1\n- 192.0.2.2\nerror: lookup example.com: timeout\n" +
+		"2024-01-02T03:04:05Z example.com A changed\n+ 192.0.2.2\n"
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+
+	w.color = true
+	out.Reset()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	w.run(ctx, sequence(cancel, "192.0.2.1", "192.0.2.2"))
+	if !strings.Contains(out.String(), "\x1b[32m+ 192.0.2.2\x1b[0m\n\x1b[31m- 192.0.2.1\x1b[0m\n") {
+		t.Errorf("expected colored changes, got %q", out.String())
+	}
+}
+
+func TestWatchHooks(t *testing.T) {
+	var mu sync.Mutex
+	var posted []recordChange
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var change recordChange
+		if err := json.Unmarshal(body, &change); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		posted = append(posted, change)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	w, out := newTestWatcher("json")
+	w.webhook = srv.URL
+	w.hook = `echo "$WATCH_TYPE $WATCH_ADDED" >> ` + filepath.Join(dir, "env") + `; cat >> ` + filepath.Join(dir, "stdin")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := w.run(ctx, sequence(cancel, "192.0.2.1", "192.0.2.1", "192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posted) != 1 || len(posted[0].Added) != 1 || posted[0].Added[0].Value != "192.0.2.2" || posted[0].Removed[0].Value != "192.0.2.1" {
+		t.Errorf("unexpected webhook calls %+v", posted)
+	}
+	env, _ := os.ReadFile(filepath.Join(dir, "env"))
+	if string(env) != "A 192.0.2.2\n" {
+		t.Errorf("unexpected hook environment %q", env)
+	}
+	stdin, _ := os.ReadFile(filepath.Join(dir, "stdin"))
+	if !strings.Contains(string(stdin), `"added":[{"name":"example.com.","ttl":300,"type":"A","value":"192.0.2.2"}]`) {
+		t.Errorf("unexpected hook input %q", stdin)
+	}
+	if !strings.Contains(out.String(), `"removed": [`) {
+		t.Errorf("expected the change as JSON, got\n%s", out.String())
+	}
+
+	// A failing hook is reported, and the watch goes on.
+	w, out = newTestWatcher("text")
+	w.hook = "exit 3"
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err := w.run(ctx, sequence(cancel, "192.0.2.1", "192.0.2.2", "192.0.2.3")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out.String(), "error: on-change hook: exit status 3") != 2 {
+		t.Errorf("expected two hook failures in\n%s", out.String())
+	}
+}
+
+func TestWatchFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"--webhook", "http://localhost/"},
+		{"--on-change", "true"},
+		{"--watch", "-1s"},
+	} {
+		_, err := runLookup(args...)
+		if exitCode(err) != 2 {
+			t.Errorf("%v: expected a usage error, got %v", args, err)
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe to read while a command writes it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatchCommand(t *testing.T) {
+	// The answer changes while its TTL is far from over, so only a watch
+	// that asks the resolver every time sees it.
+	var addr atomic.Value
+	addr.Store("192.0.2.1")
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR("example.com. 300 IN A " + addr.Load().(string))
+		resp.Answer = append(resp.Answer, rr)
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+
+	app := newApp()
+	var out lockedBuffer
+	app.Writer = &out
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run([]string{"cli", "a", "--server", "127.0.0.1", "--port", port, "--watch", "10ms", "example.com"})
+	}()
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %q in\n%s", want, out.String())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor("192.0.2.1 (TTL 300)\n")
+	addr.Store("192.0.2.2")
+	waitFor("+ 192.0.2.2\n- 192.0.2.1\n")
+
+	// The watch is listening for the interrupt by now.
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch did not stop on SIGINT")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// connTracker follows the state of the main listener's connections through
+// http.Server.ConnState.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+	total int64
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]http.ConnState)}
+}
+
+func (t *connTracker) track(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		t.total++
+		t.conns[c] = state
+	case http.StateActive, http.StateIdle:
+		t.conns[c] = state
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, c)
+	}
+}
+
+// connStats is the JSON view of the tracked connections.
+type connStats struct {
+	Open     int   `json:"open"`
+	Active   int   `json:"active"`
+	Idle     int   `json:"idle"`
+	Accepted int64 `json:"accepted"`
+}
+
+func (t *connTracker) stats() connStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := connStats{Open: len(t.conns), Accepted: t.total}
+	for _, state := range t.conns {
+		switch state {
+		case http.StateActive:
+			s.Active++
+		case http.StateIdle:
+			s.Idle++
+		}
+	}
+	return s
+}
+
+// adminStats is what /admin/stats returns.
+type adminStats struct {
+	Time        time.Time          `json:"time"`
+	Uptime      string             `json:"uptime"`
+	Counters    map[string]int     `json:"counters"`
+	Connections connStats          `json:"connections"`
+	Rates       map[string]float64 `json:"rates"`
+	Requests    []metricRow        `json:"requests"`
+	Goroutines  int                `json:"goroutines"`
+	Memory      memoryStats        `json:"memory"`
+}
+
+type memoryStats struct {
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Sys          uint64 `json:"sys"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+}
+
+// adminFiles is the dashboard, compiled into the binary so the public
+// static routes can't serve it.
+//
+//go:embed admin
+var adminFiles embed.FS
+
+// adminHandler serves the admin listener: the dashboard page with its script
+// and stylesheet, the stats it polls and the pprof profiles. It must only be
+// bound to an address that is not reachable from outside.
+func adminHandler(metrics *requestMetrics, conns *connTracker) http.Handler {
+	started := time.Now()
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, adminFiles, "admin/admin.html")
+	})
+	for _, name := range []string{"admin.css", "admin.js"} {
+		mux.HandleFunc("GET /"+name, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFileFS(w, r, adminFiles, "admin/"+name)
+		})
+	}
+
+	mux.HandleFunc("GET /admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		now := time.Now()
+		stats := adminStats{
+			Time:        now,
+			Uptime:      now.Sub(started).Round(time.Second).String(),
+			Counters:    counterValues(),
+			Connections: conns.stats(),
+			Rates:       metrics.rates(now),
+			Requests:    metrics.snapshot(),
+			Goroutines:  runtime.NumGoroutine(),
+			Memory: memoryStats{
+				Alloc:        mem.Alloc,
+				TotalAlloc:   mem.TotalAlloc,
+				Sys:          mem.Sys,
+				HeapInuse:    mem.HeapInuse,
+				HeapObjects:  mem.HeapObjects,
+				NumGC:        mem.NumGC,
+				PauseTotalNs: mem.PauseTotalNs,
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(stats)
+	})
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
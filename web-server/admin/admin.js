@@ -0,0 +1,42 @@
+function fill(id, header, rows) {
+    const table = document.getElementById(id);
+    table.innerHTML = "";
+    const head = table.insertRow();
+    header.forEach(h => {
+        const th = document.createElement("th");
+        th.textContent = h;
+        head.appendChild(th);
+    });
+    rows.forEach(row => {
+        const tr = table.insertRow();
+        row.forEach(v => tr.insertCell().textContent = v);
+    });
+}
+
+function mb(bytes) {
+    return (bytes / 1048576).toFixed(1) + " MB";
+}
+
+async function poll() {
+    try {
+        const resp = await fetch("/admin/stats");
+        const s = await resp.json();
+        document.getElementById("error").textContent = "";
+        document.getElementById("uptime").textContent = s.uptime;
+        document.getElementById("goroutines").textContent = s.goroutines;
+        fill("counters", ["name", "value"], Object.entries(s.counters));
+        fill("connections", ["open", "active", "idle", "accepted"],
+            [[s.connections.open, s.connections.active, s.connections.idle, s.connections.accepted]]);
+        fill("rates", ["route", "req/s"],
+            Object.entries(s.rates).map(([route, rate]) => [route, rate.toFixed(2)]));
+        fill("requests", ["route", "proto", "requests", "bytes", "errors", "avg ms"],
+            s.requests.map(r => [r.route, r.proto, r.requests, r.bytes, r.errors, r.avg_ms.toFixed(2)]));
+        fill("memory", ["alloc", "heap in use", "sys", "objects", "GC runs"],
+            [[mb(s.memory.alloc), mb(s.memory.heap_inuse), mb(s.memory.sys), s.memory.heap_objects, s.memory.num_gc]]);
+    } catch (err) {
+        document.getElementById("error").textContent = "(" + err + ")";
+    }
+}
+
+poll();
+setInterval(poll, 2000);
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateWindow(t *testing.T) {
+	var w rateWindow
+	start := time.Unix(1000, 0)
+	for i := 0; i < 30; i++ {
+		w.add(start.Add(time.Duration(i) * time.Second))
+	}
+	var tests = []struct {
+		at       time.Duration
+		expected int64
+	}{
+		{29 * time.Second, 30},
+		{60 * time.Second, 29},
+		{75 * time.Second, 14},
+		{2 * time.Minute, 0},
+	}
+	for _, test := range tests {
+		if got := w.count(start.Add(test.at)); got != test.expected {
+			t.Errorf("after %s: expected %d, got %d", test.at, test.expected, got)
+		}
+	}
+}
+
+func TestConnTracker(t *testing.T) {
+	tracker := newConnTracker()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	tracker.track(a, http.StateNew)
+	tracker.track(b, http.StateNew)
+	tracker.track(a, http.StateActive)
+	tracker.track(b, http.StateIdle)
+	if s := tracker.stats(); s != (connStats{Open: 2, Active: 1, Idle: 1, Accepted: 2}) {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	tracker.track(a, http.StateClosed)
+	tracker.track(b, http.StateHijacked)
+	if s := tracker.stats(); s != (connStats{Accepted: 2}) {
+		t.Errorf("unexpected stats after close %+v", s)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	resetCounter(t, "admin-test")
+	metrics := newRequestMetrics()
+	metrics.observe("HTTP/1.1", "/hi", 200, 2, time.Millisecond)
+	incrementCounter("admin-test").ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+
+	rec := httptest.NewRecorder()
+	adminHandler(metrics, newConnTracker()).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/stats", nil))
+	var stats adminStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Counters["admin-test"] != 1 || stats.Rates["/hi"] == 0 || stats.Goroutines == 0 || stats.Memory.Sys == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	rec = httptest.NewRecorder()
+	adminHandler(metrics, newConnTracker()).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 200 {
+		t.Errorf("expected the dashboard page, got %d", rec.Code)
+	}
+	for _, asset := range []string{"/admin.css", "/admin.js"} {
+		rec = httptest.NewRecorder()
+		adminHandler(metrics, newConnTracker()).ServeHTTP(rec, httptest.NewRequest("GET", asset, nil))
+		if rec.Code != 200 {
+			t.Errorf("%s: expected the dashboard's file, got %d", asset, rec.Code)
+		}
+	}
+}
+
+func TestAdminPageNotPublic(t *testing.T) {
+	cfg := &config{Routes: []routeConfig{{Path: "/", Static: "static"}}}
+	table, err := cfg.build(newRequestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	for _, path := range []string{"/admin.html", "/admin.js", "/live.html"} {
+		rec := httptest.NewRecorder()
+		table.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if public := rec.Code == 200; public != (path == "/live.html") {
+			t.Errorf("%s: unexpected status %d on the public listener", path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const certsUsage = `usage: web-server certs <command> [flags]
+
+commands:
+  ca      create the local root CA (ca.crt / ca.key)
+  issue   issue a leaf certificate signed by the local CA
+  rotate  re-issue the leaf certificate if it is missing or about to expire
+
+Run "web-server certs <command> -h" for the flags of each command.`
+
+// runCerts implements the `certs` subcommand. It keeps a small local CA in a
+// directory (./certs by default) so the server can run over HTTPS without any
+// openssl scripts: trust ca.crt once in the browser/OS and every certificate
+// issued afterwards is accepted.
+func runCerts(args []string) error {
+	if len(args) == 0 {
+		return errors.New(certsUsage)
+	}
+
+	switch args[0] {
+	case "ca":
+		fs := flag.NewFlagSet("certs ca", flag.ContinueOnError)
+		dir := fs.String("dir", "certs", "directory holding the CA and certificates")
+		cn := fs.String("cn", "web-server local CA", "common name of the root CA")
+		days := fs.Int("days", 3650, "validity of the root CA in days")
+		force := fs.Bool("force", false, "overwrite an existing CA")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if !*force && fileExists(filepath.Join(*dir, "ca.crt")) {
+			return fmt.Errorf("CA already exists in %s (use -force to replace it)", *dir)
+		}
+		ca, err := createCA(*dir, *cn, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created CA %q valid until %s in %s\n", ca.cert.Subject.CommonName, ca.cert.NotAfter.Format(time.RFC3339), *dir)
+		return nil
+
+	case "issue", "rotate":
+		fs := flag.NewFlagSet("certs "+args[0], flag.ContinueOnError)
+		dir := fs.String("dir", "certs", "directory holding the CA and certificates")
+		name := fs.String("name", "server", "base name of the generated <name>.crt / <name>.key")
+		hosts := fs.String("hosts", "localhost,127.0.0.1,::1", "comma separated hostnames and IPs to put in the SAN (rotate: those of the current certificate)")
+		days := fs.Int("days", 30, "validity of the leaf certificate in days")
+		before := fs.Duration("before", 7*24*time.Hour, "rotate: renew when the certificate expires within this window")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		ca, err := loadOrCreateCA(*dir)
+		if err != nil {
+			return err
+		}
+		certPath := filepath.Join(*dir, *name+".crt")
+		sans := splitHosts(*hosts)
+		hostsSet := false
+		fs.Visit(func(f *flag.Flag) { hostsSet = hostsSet || f.Name == "hosts" })
+		if args[0] == "rotate" && !hostsSet {
+			if cert, err := readCert(certPath); err == nil {
+				sans = certHosts(cert)
+			}
+		}
+
+		if args[0] == "rotate" {
+			reason := needsRotation(certPath, ca, sans, *before, time.Now())
+			if reason == "" {
+				fmt.Printf("%s is still valid, nothing to do\n", certPath)
+				return nil
+			}
+			fmt.Printf("rotating %s: %s\n", certPath, reason)
+		}
+
+		leaf, err := issueCert(*dir, *name, ca, sans, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("issued %s for %s valid until %s\n", certPath, strings.Join(sans, ", "), leaf.NotAfter.Format(time.RFC3339))
+		return nil
+
+	default:
+		return fmt.Errorf("unknown certs command %q\n\n%s", args[0], certsUsage)
+	}
+}
+
+type certAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// createCA generates a new self-signed root CA and writes ca.crt / ca.key
+// into dir.
+func createCA(dir, commonName string, validity time.Duration) (*certAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"web-server development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writePair(dir, "ca", der, key); err != nil {
+		return nil, err
+	}
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+// loadCA reads ca.crt / ca.key from dir.
+func loadCA(dir string) (*certAuthority, error) {
+	cert, err := readCert(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "ca.key"))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", filepath.Join(dir, "ca.key"))
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{cert: cert, key: key}, nil
+}
+
+// loadOrCreateCA loads the CA from dir, creating one with default settings
+// the first time so `certs issue` works out of the box.
+func loadOrCreateCA(dir string) (*certAuthority, error) {
+	if fileExists(filepath.Join(dir, "ca.crt")) {
+		return loadCA(dir)
+	}
+	fmt.Printf("no CA found in %s, creating one\n", dir)
+	return createCA(dir, "web-server local CA", 3650*24*time.Hour)
+}
+
+// issueCert creates a leaf certificate for the given hostnames/IPs signed by
+// ca and writes <name>.crt / <name>.key into dir. The certificate file
+// contains the leaf followed by the CA so it can be served as a full chain.
+func issueCert(dir, name string, ca *certAuthority, hosts []string, validity time.Duration) (*x509.Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("at least one hostname or IP is required")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0], Organization: []string{"web-server development"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writePair(dir, name, der, key, ca.cert.Raw); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// certHosts returns the hostnames and IPs in the SAN of cert.
+func certHosts(cert *x509.Certificate) []string {
+	hosts := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	return hosts
+}
+
+// needsRotation reports why the certificate at path must be re-issued, or ""
+// when it is still good: it exists, was signed by ca, covers every host and
+// does not expire within the given window.
+func needsRotation(path string, ca *certAuthority, hosts []string, window time.Duration, now time.Time) string {
+	cert, err := readCert(path)
+	if err != nil {
+		return "cannot read certificate: " + err.Error()
+	}
+	if err := cert.CheckSignatureFrom(ca.cert); err != nil {
+		return "not signed by the current CA"
+	}
+	for _, h := range hosts {
+		if err := cert.VerifyHostname(h); err != nil {
+			return "does not cover " + h
+		}
+	}
+	if now.Add(window).After(cert.NotAfter) {
+		return "expires " + cert.NotAfter.Format(time.RFC3339)
+	}
+	return ""
+}
+
+// writePair writes <name>.crt (der followed by any extra chain certificates)
+// and <name>.key into dir.
+func writePair(dir, name string, der []byte, key *ecdsa.PrivateKey, chain ...[]byte) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	var certPEM []byte
+	for _, c := range append([][]byte{der}, chain...) {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	// Write both files next to their final names and rename them only once
+	// both are on disk, so a failed write never leaves a certificate and a
+	// key that don't belong together. The pair as a whole is not replaced
+	// atomically: a reader between the renames gets the new certificate
+	// with the old key, which tls.LoadX509KeyPair rejects. Load the pair
+	// once the command has finished.
+	keyTmp, err := writeTemp(dir, keyPEM, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyTmp)
+	certTmp, err := writeTemp(dir, certPEM, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(certTmp)
+
+	if err := os.Rename(certTmp, filepath.Join(dir, name+".crt")); err != nil {
+		return err
+	}
+	return os.Rename(keyTmp, filepath.Join(dir, name+".key"))
+}
+
+// writeTemp writes data to a new temporary file in dir and returns its
+// path.
+func writeTemp(dir string, data []byte, perm os.FileMode) (string, error) {
+	f, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// readCert parses the first certificate of a PEM file.
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate PEM block", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func splitHosts(s string) []string {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
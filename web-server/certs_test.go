@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssueCertSANs(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := createCA(dir, "test CA", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issueCert(dir, "server", ca, []string{"localhost", "dev.local", "127.0.0.1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// The generated pair must be loadable by crypto/tls as-is.
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pair.Certificate) != 2 {
+		t.Errorf("expected leaf + CA in chain, got %d certificates", len(pair.Certificate))
+	}
+
+	leaf, err := readCert(filepath.Join(dir, "server.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	for _, host := range []string{"localhost", "dev.local", "127.0.0.1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("verify %s: %v", host, err)
+		}
+	}
+	if err := leaf.VerifyHostname("example.com"); err == nil {
+		t.Error("certificate unexpectedly valid for example.com")
+	}
+}
+
+func TestNeedsRotation(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := createCA(dir, "test CA", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issueCert(dir, "server", ca, []string{"localhost"}, 10*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "server.crt")
+	now := time.Now()
+
+	var tests = []struct {
+		name   string
+		hosts  []string
+		window time.Duration
+		rotate bool
+	}{
+		{"valid", []string{"localhost"}, time.Hour, false},
+		{"expiring", []string{"localhost"}, 20 * time.Hour, true},
+		{"new host", []string{"localhost", "api.local"}, time.Hour, true},
+	}
+	for _, test := range tests {
+		reason := needsRotation(path, ca, test.hosts, test.window, now)
+		if (reason != "") != test.rotate {
+			t.Errorf("%s: expected rotate=%v, got reason %q", test.name, test.rotate, reason)
+		}
+	}
+
+	// A certificate signed by a previous CA must be replaced.
+	other, err := createCA(t.TempDir(), "other CA", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := needsRotation(path, other, []string{"localhost"}, time.Hour, now); reason == "" {
+		t.Error("expected rotation for certificate signed by another CA")
+	}
+	if reason := needsRotation(filepath.Join(dir, "missing.crt"), ca, []string{"localhost"}, time.Hour, now); reason == "" {
+		t.Error("expected rotation for missing certificate")
+	}
+}
+
+func TestWritePairReplacesBoth(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := createCA(dir, "test CA", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotating over an existing pair leaves a matching pair and no
+	// temporary files behind.
+	for i := 0; i < 2; i++ {
+		if _, err := issueCert(dir, "server", ca, []string{"localhost"}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, ".tmp-*")); len(tmp) != 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+	info, err := os.Stat(filepath.Join(dir, "server.key"))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the key to be private, got %v %v", info.Mode(), err)
+	}
+}
+
+func TestRotateKeepsHosts(t *testing.T) {
+	dir := t.TempDir()
+	if err := runCerts([]string{"issue", "-dir", dir, "-hosts", "app.example,192.0.2.7", "-days", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Expiring within the window forces the rotation.
+	if err := runCerts([]string{"rotate", "-dir", dir, "-before", "48h"}); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := readCert(filepath.Join(dir, "server.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(certHosts(cert), ","); got != "app.example,192.0.2.7" || cert.NotAfter.Before(time.Now().Add(48*time.Hour)) {
+		t.Errorf("expected a renewed certificate for app.example,192.0.2.7, got %s until %v", got, cert.NotAfter)
+	}
+}
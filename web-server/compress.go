@@ -0,0 +1,308 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionConfig controls the response compression applied to every
+// route of the config. Compression is on by default.
+type compressionConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// Encodings lists the supported encodings in server preference order;
+	// the first one the client accepts wins.
+	Encodings []string `json:"encodings,omitempty"`
+	// Types is the allowlist of compressible media types, either exact
+	// ("application/json") or wildcards ("text/*").
+	Types []string `json:"types,omitempty"`
+	// MinSize is the smallest body, in bytes, worth compressing.
+	MinSize int `json:"min_size,omitempty"`
+}
+
+var defaultCompression = compressionConfig{
+	Encodings: []string{"zstd", "br", "gzip"},
+	Types: []string{
+		"text/*",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"image/svg+xml",
+	},
+	MinSize: 512,
+}
+
+// encoder is the common interface of the gzip, brotli and zstd writers.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// encoderPools reuse encoders, which are expensive to allocate (zstd in
+// particular).
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		return gzip.NewWriter(io.Discard)
+	}},
+	"br": {New: func() any {
+		return brotli.NewWriter(io.Discard)
+	}},
+	"zstd": {New: func() any {
+		// Browsers refuse zstd windows above 8MB; a single goroutine keeps
+		// the encoder cheap for small responses.
+		enc, _ := zstd.NewWriter(io.Discard, zstd.WithWindowSize(8<<20), zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+}
+
+// compressor is a compressionConfig ready to wrap handlers.
+type compressor struct {
+	encodings []string
+	types     []string
+	minSize   int
+}
+
+func newCompressor(cfg *compressionConfig) (*compressor, error) {
+	c := defaultCompression
+	if cfg != nil {
+		if cfg.Disabled {
+			return nil, nil
+		}
+		if len(cfg.Encodings) > 0 {
+			c.Encodings = cfg.Encodings
+		}
+		if len(cfg.Types) > 0 {
+			c.Types = cfg.Types
+		}
+		if cfg.MinSize > 0 {
+			c.MinSize = cfg.MinSize
+		}
+	}
+	for _, enc := range c.Encodings {
+		if encoderPools[enc] == nil {
+			return nil, fmt.Errorf("compression: unsupported encoding %q", enc)
+		}
+	}
+	return &compressor{encodings: c.Encodings, types: c.Types, minSize: c.MinSize}, nil
+}
+
+// wrap compresses the responses of next. A nil compressor leaves next
+// untouched.
+func (c *compressor) wrap(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Byte ranges always refer to the uncompressed representation, and
+		// upgraded (WebSocket) connections carry no HTTP body at all.
+		encoding := c.negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, c: c, encoding: encoding, status: http.StatusOK}
+		// The handler compares If-None-Match with its own ETag, which gets
+		// the encoding suffix only on the way out.
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			if stripped := strings.ReplaceAll(inm, "-"+encoding+`"`, `"`); stripped != inm {
+				r = r.Clone(r.Context())
+				r.Header.Set("If-None-Match", stripped)
+				cw.encodedMatch = true
+			}
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiate picks the first server-preferred encoding the Accept-Encoding
+// header allows, or "" for identity.
+func (c *compressor) negotiate(accept string) string {
+	if accept == "" {
+		return ""
+	}
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+	for _, enc := range c.encodings {
+		w, ok := q[enc]
+		if !ok {
+			w, ok = q["*"]
+		}
+		if ok && w > 0 {
+			return enc
+		}
+	}
+	return ""
+}
+
+func (c *compressor) allowedType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		if t == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter holds back the first minSize bytes of the body to decide
+// whether compressing is worth it, then either streams through an encoder
+// or writes the body unchanged.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *compressor
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder
+	// encodedMatch is set when If-None-Match named the compressed
+	// representation, which a 304 then names too.
+	encodedMatch bool
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided {
+		return
+	}
+	if status >= 100 && status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	if status != http.StatusOK {
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.c.minSize {
+			return len(p), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush decides right away (a streaming handler wants its bytes on the
+// wire) and flushes the encoder and the connection.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close writes whatever is still buffered and finishes the encoder.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	w.enc.Reset(io.Discard)
+	encoderPools[w.encoding].Put(w.enc)
+	w.enc = nil
+	return err
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// decide sends the headers and the buffered bytes. large reports that the
+// body reached minSize (or is streamed); a body that ended below it is
+// sent uncompressed.
+func (w *compressWriter) decide(large bool) error {
+	w.decided = true
+	h := w.Header()
+	if etag := h.Get("ETag"); etag != "" && w.status == http.StatusNotModified && w.encodedMatch {
+		h.Set("ETag", encodedETag(etag, w.encoding))
+	}
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// Same sniffing net/http would do on the first write.
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	compress := w.status == http.StatusOK &&
+		h.Get("Content-Encoding") == "" &&
+		h.Get("Content-Range") == "" &&
+		w.c.allowedType(h.Get("Content-Type"))
+	if compress {
+		h.Add("Vary", "Accept-Encoding")
+		if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+			large = n >= w.c.minSize
+		}
+	}
+
+	if compress && large {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		// The compressed bytes can't serve byte ranges, and validators must
+		// differ from the identity representation so If-Range never
+		// matches them.
+		h.Del("Accept-Ranges")
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", encodedETag(etag, w.encoding))
+		}
+		w.ResponseWriter.WriteHeader(w.status)
+		w.enc = encoderPools[w.encoding].Get().(encoder)
+		w.enc.Reset(w.ResponseWriter)
+		_, err := w.enc.Write(w.buf)
+		w.buf = nil
+		return err
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// encodedETag is the ETag of the representation compressed with encoding.
+func encodedETag(etag, encoding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	c, err := newCompressor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		accept   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, br, zstd", "zstd"},
+		{"zstd;q=0, br;q=0.5, gzip", "br"},
+		{"*", "zstd"},
+		{"*;q=0, gzip", "gzip"},
+		{"identity", ""},
+	}
+	for _, test := range tests {
+		if got := c.negotiate(test.accept); got != test.expected {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", test.accept, test.expected, got)
+		}
+	}
+}
+
+func decode(t *testing.T, encoding string, body []byte) string {
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return string(body)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestCompressDynamicResponses(t *testing.T) {
+	large := strings.Repeat("Hi ", 400)
+	c, err := newCompressor(&compressionConfig{MinSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/large", &cannedResponse{Body: large})
+	mux.Handle("/small", &cannedResponse{Body: "Hi"})
+	mux.Handle("/png", &cannedResponse{ContentType: "image/png", Body: large})
+	mux.Handle("/missing", http.NotFoundHandler())
+	h := c.wrap(mux)
+
+	var tests = []struct {
+		path     string
+		accept   string
+		encoding string
+		body     string
+	}{
+		{"/large", "gzip", "gzip", large},
+		{"/large", "br", "br", large},
+		{"/large", "zstd, gzip", "zstd", large},
+		{"/large", "", "", large},
+		{"/small", "gzip", "", "Hi"},
+		{"/png", "gzip", "", large},
+		{"/missing", "gzip", "", "404 page not found\n"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept-Encoding", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Encoding"); got != test.encoding {
+			t.Errorf("%s with %q: expected encoding %q, got %q", test.path, test.accept, test.encoding, got)
+			continue
+		}
+		if body := decode(t, test.encoding, rec.Body.Bytes()); body != test.body {
+			t.Errorf("%s with %q: body mismatch (%d bytes)", test.path, test.accept, len(body))
+		}
+	}
+}
+
+func TestStaticRangeRequests(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("0123456789", 1000)
+	if err := os.WriteFile(filepath.Join(dir, "big.txt"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newCompressor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.wrap(staticHandler(dir))
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/big.txt", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The full download is compressed and carries a distinct validator.
+	full := get(nil)
+	if full.Header().Get("Content-Encoding") != "gzip" || decode(t, "gzip", full.Body.Bytes()) != content {
+		t.Fatal("expected a gzip encoded full response")
+	}
+	identity := get(map[string]string{"Accept-Encoding": "identity"})
+	etag := identity.Header().Get("ETag")
+	if etag == "" || etag == full.Header().Get("ETag") {
+		t.Fatalf("expected distinct ETags, got %q and %q", etag, full.Header().Get("ETag"))
+	}
+
+	// Revalidating either representation is answered with a 304 naming
+	// the one the client has.
+	for _, test := range []struct {
+		encoding, etag string
+	}{
+		{"gzip", full.Header().Get("ETag")},
+		{"identity", etag},
+	} {
+		rec := get(map[string]string{"Accept-Encoding": test.encoding, "If-None-Match": test.etag})
+		if rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != test.etag {
+			t.Errorf("%s: expected a 304 with ETag %s, got %d %q", test.encoding, test.etag, rec.Code, rec.Header().Get("ETag"))
+		}
+	}
+
+	var tests = []struct {
+		name    string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{"range", map[string]string{"Range": "bytes=10-19"}, 206, content[10:20]},
+		{"resume", map[string]string{"Range": "bytes=9990-"}, 206, content[9990:]},
+		{"if-range match", map[string]string{"Range": "bytes=0-4", "If-Range": etag}, 206, content[:5]},
+		{"if-range stale", map[string]string{"Range": "bytes=0-4", "If-Range": `"stale"`}, 200, content},
+		{"if-range compressed etag", map[string]string{"Range": "bytes=0-4", "If-Range": full.Header().Get("ETag")}, 200, content},
+		{"unsatisfiable", map[string]string{"Range": "bytes=20000-"}, 416, ""},
+	}
+	for _, test := range tests {
+		rec := get(test.headers)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rec.Code)
+			continue
+		}
+		if rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: range requests must not be compressed", test.name)
+		}
+		if test.body != "" && rec.Body.String() != test.body {
+			t.Errorf("%s: unexpected body of %d bytes", test.name, rec.Body.Len())
+		}
+	}
+}
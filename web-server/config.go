@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/alexandreafj/golang-study/accesslog"
+)
+
+// config is the declarative description of the server's routes, loaded from
+// the -config JSON file. See routes.json for an example.
+//
+// Routes and AccessLog belong to the default host, which answers every
+// request whose Host doesn't match one of Hosts.
+type config struct {
+	Routes    []routeConfig `json:"routes"`
+	AccessLog string        `json:"access_log,omitempty"`
+	Hosts     []hostConfig  `json:"hosts,omitempty"`
+	// AccessLogOptions sets the format and rotation of all access logs.
+	AccessLogOptions accessLogConfig `json:"access_log_options,omitempty"`
+	// Compression applies to the responses of every host; nil means the
+	// defaults.
+	Compression *compressionConfig `json:"compression,omitempty"`
+	// Security sets the security headers and CSRF protection of every
+	// host; nil means the defaults.
+	Security *securityConfig `json:"security,omitempty"`
+	// Sessions configures the session store shared by all hosts.
+	Sessions *sessionConfig `json:"sessions,omitempty"`
+	// Templates selects where the pages of "template" routes come from;
+	// nil means the templates embedded in the binary.
+	Templates *templateConfig `json:"templates,omitempty"`
+}
+
+// routeConfig mounts exactly one kind of handler on Path, which is a
+// http.ServeMux pattern such as "/hi", "/api/" or "GET /status".
+type routeConfig struct {
+	Path string `json:"path"`
+
+	// Static serves files from this directory.
+	Static string `json:"static,omitempty"`
+	// Template renders the named page of the templates' pages/ directory.
+	Template string `json:"template,omitempty"`
+	// Respond always answers with the same response.
+	Respond *cannedResponse `json:"respond,omitempty"`
+	// Counter serves the named counter: POST increments it, GET reads it.
+	Counter string `json:"counter,omitempty"`
+	// CounterScope is "global" (the default, shared by everyone) or
+	// "session" (one counter per visitor).
+	CounterScope string `json:"counter_scope,omitempty"`
+	// Watch streams the changes of the named counter over a WebSocket.
+	Watch string `json:"watch,omitempty"`
+	// Proxy forwards to upstream backends; its prefix is Path.
+	Proxy *proxyConfig `json:"proxy,omitempty"`
+	// Metrics exposes the per-protocol request metrics as JSON.
+	Metrics bool `json:"metrics,omitempty"`
+}
+
+type cannedResponse struct {
+	Status      int               `json:"status,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        string            `json:"body"`
+}
+
+func (c *cannedResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for k, v := range c.Headers {
+		w.Header().Set(k, v)
+	}
+	if c.ContentType != "" {
+		w.Header().Set("Content-Type", c.ContentType)
+	}
+	if c.Status != 0 {
+		w.WriteHeader(c.Status)
+	}
+	fmt.Fprint(w, c.Body)
+}
+
+// defaultConfig reproduces the routes the server always had, used when no
+// -config file is given.
+func defaultConfig() *config {
+	return &config{Routes: []routeConfig{
+		{Path: "GET /{$}", Template: "index.html"},
+		{Path: "/", Static: "./static"},
+		{Path: "/increment", Counter: "counter"},
+		{Path: "GET /increment/ws", Watch: "counter"},
+		{Path: "/hi", Respond: &cannedResponse{Body: "Hi"}},
+		{Path: "/metrics", Metrics: true},
+	}}
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// routeTable is one generation of routes built from a config.
+type routeTable struct {
+	// hosts maps normalized host names (and "*.suffix" wildcards) to their
+	// virtual host; fallback is the default host and may be nil.
+	hosts    map[string]*virtualHost
+	fallback *virtualHost
+	proxies  []*loadBalancer
+	// logs are the access logs this table opened rather than took over
+	// from the previous one.
+	logs []string
+}
+
+// build turns the config into a routeTable. Nothing is left running when it
+// fails, so a broken config file can be rejected on reload.
+func (c *config) build(metrics *requestMetrics) (_ *routeTable, err error) {
+	table := &routeTable{hosts: make(map[string]*virtualHost)}
+	defer func() {
+		// ServeMux panics on invalid or duplicate patterns.
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+		if err != nil {
+			table.close()
+			// Sessions and templates hold no files or goroutines; access
+			// logs opened for this table do.
+			for _, path := range table.logs {
+				closeAccessLog(path)
+			}
+		}
+	}()
+
+	if len(c.Routes) == 0 && len(c.Hosts) == 0 {
+		return nil, errors.New("config has no routes")
+	}
+	comp, err := newCompressor(c.Compression)
+	if err != nil {
+		return nil, err
+	}
+	format, err := accesslog.ParseFormat(c.AccessLogOptions.Format)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := newSessionManager(c.Sessions)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := newTemplateSet(c.Templates)
+	if err != nil {
+		return nil, err
+	}
+	defaults := hostDefaults{
+		compressor: comp,
+		sessions:   sessions,
+		templates:  templates,
+		security:   newSecurityHeaders(c.Security),
+		logFormat:  format,
+		logOptions: c.AccessLogOptions.options(),
+		metrics:    metrics,
+	}
+	if len(c.Routes) > 0 {
+		vh, err := buildHost(hostConfig{Routes: c.Routes, AccessLog: c.AccessLog}, table, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("default host: %w", err)
+		}
+		table.fallback = vh
+	}
+	for _, h := range c.Hosts {
+		if len(h.Names) == 0 {
+			return nil, errors.New("host without names")
+		}
+		vh, err := buildHost(h, table, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", h.Names[0], err)
+		}
+		for _, name := range h.Names {
+			name = normalizeHost(name)
+			if _, dup := table.hosts[name]; dup {
+				return nil, fmt.Errorf("host %s configured twice", name)
+			}
+			table.hosts[name] = vh
+		}
+	}
+	return table, nil
+}
+
+func (r *routeConfig) handler(defaults hostDefaults) (http.Handler, error) {
+	var handlers []http.Handler
+	if r.Static != "" {
+		static := staticHandler(r.Static)
+		// A subtree mount serves its directory at the mount point, e.g.
+		// /assets/app.css from <static>/app.css.
+		if prefix := patternPath(r.Path); prefix != "/" && strings.HasSuffix(prefix, "/") {
+			static = http.StripPrefix(strings.TrimSuffix(prefix, "/"), static)
+		}
+		handlers = append(handlers, static)
+	}
+	if r.Template != "" {
+		page, err := defaults.templates.page(r.Template)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, page)
+	}
+	if r.Respond != nil {
+		handlers = append(handlers, r.Respond)
+	}
+	if r.Counter != "" {
+		switch r.CounterScope {
+		case "", "global":
+			handlers = append(handlers, incrementCounter(r.Counter))
+		case "session":
+			handlers = append(handlers, sessionCounter(r.Counter))
+		default:
+			return nil, fmt.Errorf("unknown counter_scope %q", r.CounterScope)
+		}
+	}
+	if r.Watch != "" {
+		handlers = append(handlers, watchCounter(r.Watch, defaultKeepalive))
+	}
+	if r.Metrics {
+		handlers = append(handlers, defaults.metrics)
+	}
+	if r.Proxy != nil {
+		cfg := *r.Proxy
+		cfg.Prefix = patternPath(r.Path)
+		lb, err := newLoadBalancer(cfg)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, lb)
+	}
+
+	if len(handlers) != 1 {
+		for _, h := range handlers {
+			if lb, ok := h.(*loadBalancer); ok {
+				lb.Close()
+			}
+		}
+		return nil, errors.New("exactly one of static, template, respond, counter, watch, proxy or metrics must be set")
+	}
+	return handlers[0], nil
+}
+
+// patternPath returns the path of a ServeMux pattern, without the method
+// and host: "/api/" for "GET example.com/api/".
+func patternPath(pattern string) string {
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		pattern = strings.TrimLeft(pattern[i:], " \t")
+	}
+	if i := strings.IndexByte(pattern, '/'); i > 0 {
+		pattern = pattern[i:]
+	}
+	return pattern
+}
+
+// close stops the background work (health checks) of the table's proxies.
+func (t *routeTable) close() {
+	for _, lb := range t.proxies {
+		lb.Close()
+	}
+}
+
+// router serves requests from the current routeTable. Swapping the table
+// only affects new requests; in-flight ones finish on the table they
+// started with and connections are never touched.
+type router struct {
+	table atomic.Pointer[routeTable]
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.table.Load().ServeHTTP(w, r)
+}
+
+func (rt *router) swap(table *routeTable) {
+	if old := rt.table.Swap(table); old != nil {
+		old.close()
+	}
+}
+
+// reloadOnSignal rebuilds the routes from the config file every time the
+// process receives SIGHUP. A config that fails to load keeps the current
+// routes in place.
+func reloadOnSignal(rt *router, load func() (*config, error), metrics *requestMetrics) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		cfg, err := load()
+		if err != nil {
+			log.Printf("reload: %v (keeping current routes)", err)
+			continue
+		}
+		table, err := cfg.build(metrics)
+		if err != nil {
+			log.Printf("reload: %v (keeping current routes)", err)
+			continue
+		}
+		rt.swap(table)
+		log.Printf("reload: %d routes and %d virtual hosts active", len(cfg.Routes), len(cfg.Hosts))
+	}
+}
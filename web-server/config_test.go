@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigBuild(t *testing.T) {
+	cfg, err := loadConfig("routes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the example's access logs out of the source tree.
+	cfg.AccessLog = filepath.Join(t.TempDir(), "access.log")
+	for i := range cfg.Hosts {
+		cfg.Hosts[i].AccessLog = ""
+	}
+	cfg.Sessions.Dir = t.TempDir()
+	table, err := cfg.build(newRequestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+
+	var tests = []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{"GET", "/", 200, ""},
+		{"GET", "/hi", 200, "Hi"},
+		{"GET", "/status", 200, `{"status":"ok"}`},
+		{"POST", "/status", 403, ""}, // no CSRF token
+		{"GET", "/index.html", 301, ""},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		table.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, nil))
+		if rec.Code != test.status || (test.body != "" && rec.Body.String() != test.body) {
+			t.Errorf("%s %s: expected %d %q, got %d %q", test.method, test.path, test.status, test.body, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestConfigBuildErrors(t *testing.T) {
+	var tests = []struct {
+		name   string
+		routes []routeConfig
+	}{
+		{"empty", nil},
+		{"no handler", []routeConfig{{Path: "/x"}}},
+		{"two handlers", []routeConfig{{Path: "/x", Static: ".", Counter: "c"}}},
+		{"duplicate path", []routeConfig{{Path: "/x", Static: "."}, {Path: "/x", Static: "."}}},
+		{"bad proxy", []routeConfig{{Path: "/x/", Proxy: &proxyConfig{}}}},
+	}
+	for _, test := range tests {
+		cfg := &config{Routes: test.routes}
+		if _, err := cfg.build(newRequestMetrics()); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestConfigBuildClosesAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	cfg := &config{AccessLog: path, Routes: []routeConfig{{Path: "/x/", Proxy: &proxyConfig{}}}}
+	if _, err := cfg.build(newRequestMetrics()); err == nil {
+		t.Fatal("expected an error")
+	}
+	accessLogs.Lock()
+	_, open := accessLogs.writers[path]
+	accessLogs.Unlock()
+	if open {
+		t.Error("the access log of the failed build was left open")
+	}
+}
+
+func TestStaticMount(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/assets/", "GET /assets/", "GET localhost/assets/"} {
+		if got := patternPath(path); got != "/assets/" {
+			t.Errorf("%s: expected the path /assets/, got %q", path, got)
+		}
+		cfg := &config{Routes: []routeConfig{{Path: path, Static: dir}}, Security: &securityConfig{Disabled: true}}
+		table, err := cfg.build(newRequestMetrics())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for target, status := range map[string]int{"/assets/app.css": 200, "/assets/assets/app.css": 404} {
+			req := httptest.NewRequest("GET", target, nil)
+			req.Host = "localhost"
+			rec := httptest.NewRecorder()
+			table.ServeHTTP(rec, req)
+			if rec.Code != status || (status == 200 && rec.Body.String() != "body{}") {
+				t.Errorf("%s: GET %s: expected %d, got %d %q", path, target, status, rec.Code, rec.Body.String())
+			}
+		}
+		table.close()
+	}
+}
+
+func TestRouterSwapKeepsCounters(t *testing.T) {
+	resetCounter(t, "swap-test")
+	path := filepath.Join(t.TempDir(), "routes.json")
+	write := func(body string) {
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	post := func(rt http.Handler, p string) int {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest("POST", p, nil))
+		var c counterState
+		json.Unmarshal(rec.Body.Bytes(), &c)
+		return c.Value
+	}
+	reload := func(rt *router) {
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table, err := cfg.build(newRequestMetrics())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt.swap(table)
+	}
+
+	rt := &router{}
+	write(`{"routes": [{"path": "/count", "counter": "swap-test"}], "security": {"disabled": true}}`)
+	reload(rt)
+	if got := post(rt, "/count"); got != 1 {
+		t.Errorf("expected 1, got %d", got)
+	}
+
+	write(`{"routes": [{"path": "/again", "counter": "swap-test"}], "security": {"disabled": true}}`)
+	reload(rt)
+	if got := post(rt, "/again"); got != 2 {
+		t.Errorf("expected counter to survive reload, got %d", got)
+	}
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest("GET", "/count", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected old route to be gone, got %d", rec.Code)
+	}
+}
@@ -1,3 +1,21 @@
 module github.com/alexandreafj/golang-study/web-server
 
-go 1.19
+go 1.26.0
+
+require (
+	github.com/alexandreafj/golang-study/accesslog v0.0.0
+	github.com/andybalholm/brotli v1.2.6
+	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.20.1
+	github.com/quic-go/quic-go v0.63.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
+
+replace github.com/alexandreafj/golang-study/accesslog => ../accesslog
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// requestMetrics counts requests per protocol (HTTP/1.1, HTTP/2.0, HTTP/3.0)
+// and per route so the behaviour of the same handler can be compared across
+// protocols.
+type requestMetrics struct {
+	mu     sync.Mutex
+	stats  map[metricKey]*routeStats
+	recent map[string]*rateWindow
+}
+
+type metricKey struct {
+	proto string
+	route string
+}
+
+type routeStats struct {
+	Requests int64         `json:"requests"`
+	Bytes    int64         `json:"bytes"`
+	Errors   int64         `json:"errors"`
+	Total    time.Duration `json:"-"`
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		stats:  make(map[metricKey]*routeStats),
+		recent: make(map[string]*rateWindow),
+	}
+}
+
+func (m *requestMetrics) observe(proto, route string, status int, bytes int64, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricKey{proto, route}
+	s, ok := m.stats[key]
+	if !ok {
+		s = &routeStats{}
+		m.stats[key] = s
+	}
+	w, ok := m.recent[route]
+	if !ok {
+		w = &rateWindow{}
+		m.recent[route] = w
+	}
+	w.add(time.Now())
+
+	s.Requests++
+	s.Bytes += bytes
+	s.Total += took
+	if status >= 500 {
+		s.Errors++
+	}
+}
+
+// rates returns the average requests per second of every route over the
+// last minute, all protocols together.
+func (m *requestMetrics) rates(now time.Time) map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rates := make(map[string]float64, len(m.recent))
+	for route, w := range m.recent {
+		rates[route] = float64(w.count(now)) / rateWindowSeconds
+	}
+	return rates
+}
+
+const rateWindowSeconds = 60
+
+// rateWindow counts events in one-second buckets over the last minute.
+type rateWindow struct {
+	buckets [rateWindowSeconds]int64
+	seconds [rateWindowSeconds]int64
+}
+
+func (w *rateWindow) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % rateWindowSeconds
+	if w.seconds[i] != sec {
+		w.seconds[i] = sec
+		w.buckets[i] = 0
+	}
+	w.buckets[i]++
+}
+
+func (w *rateWindow) count(now time.Time) int64 {
+	var n int64
+	oldest := now.Unix() - rateWindowSeconds
+	for i, sec := range w.seconds {
+		if sec > oldest {
+			n += w.buckets[i]
+		}
+	}
+	return n
+}
+
+// metricRow is the JSON representation of one protocol/route pair.
+type metricRow struct {
+	Proto     string  `json:"proto"`
+	Route     string  `json:"route"`
+	Requests  int64   `json:"requests"`
+	Bytes     int64   `json:"bytes"`
+	Errors    int64   `json:"errors"`
+	AvgMillis float64 `json:"avg_ms"`
+}
+
+// snapshot returns the current counters sorted by route then protocol.
+func (m *requestMetrics) snapshot() []metricRow {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := make([]metricRow, 0, len(m.stats))
+	for k, s := range m.stats {
+		rows = append(rows, metricRow{
+			Proto:     k.proto,
+			Route:     k.route,
+			Requests:  s.Requests,
+			Bytes:     s.Bytes,
+			Errors:    s.Errors,
+			AvgMillis: float64(s.Total) / float64(time.Millisecond) / float64(s.Requests),
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Route != rows[j].Route {
+			return rows[i].Route < rows[j].Route
+		}
+		return rows[i].Proto < rows[j].Proto
+	})
+	return rows
+}
+
+// ServeHTTP writes the snapshot as JSON.
+func (m *requestMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.snapshot())
+}
+
+// unmatchedRoute is the route of requests no pattern matched: 404s,
+// unknown hosts and requests rejected before routing. Their paths are up
+// to the client, so they must not each get an entry.
+const unmatchedRoute = "(unmatched)"
+
+// middleware records every request passing through next. The route is the
+// ServeMux pattern that matched (e.g. "/hi" or "/" for static files) so
+// metrics don't explode with one entry per static path.
+func (m *requestMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		pattern := new(string)
+		req := r.WithContext(context.WithValue(r.Context(), patternKey{}, pattern))
+		next.ServeHTTP(rec, req)
+		// A mux right below sets the pattern of req itself.
+		route := *pattern
+		if route == "" {
+			route = req.Pattern
+		}
+		if route == "" {
+			route = unmatchedRoute
+		}
+		m.observe(r.Proto, route, rec.status, rec.bytes, time.Since(start))
+	})
+}
+
+// patternKey holds where notePattern leaves the matched pattern. The
+// handlers between the middleware and the mux pass copies of the request
+// on, so its Pattern field never makes it back up.
+type patternKey struct{}
+
+// notePattern wraps a ServeMux, which sets the Pattern of the request it
+// is given, and reports the pattern to the metrics middleware.
+func notePattern(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if p, ok := r.Context().Value(patternKey{}).(*string); ok {
+			*p = r.Pattern
+		}
+	})
+}
+
+// statusRecorder captures the status code and body size written by a
+// handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (Flush,
+// Hijack, deadlines).
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Flush is for handlers that assert http.Flusher; the writers wrapped by
+// the middleware may only offer it by unwrapping.
+func (r *statusRecorder) Flush() {
+	r.wroteHeader = true
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Hijack is for WebSocket libraries, which assert http.Hijacker instead of
+// using a ResponseController.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
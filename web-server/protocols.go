@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newServer builds the main http.Server. HTTP/1.1 is always on and HTTP/2 is
+// negotiated through ALPN when the server runs with TLS. With h2c the
+// cleartext listener also accepts HTTP/2 with prior knowledge, which is what
+// internal clients (e.g. `curl --http2-prior-knowledge`) use.
+func newServer(addr string, handler http.Handler, h2c bool) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(h2c)
+
+	return &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		Protocols: &protocols,
+	}
+}
+
+// advertiseHTTP3 adds an Alt-Svc header to HTTP/1 and HTTP/2 responses so
+// browsers know they can switch to the QUIC listener on addr.
+func advertiseHTTP3(addr string, next http.Handler) (http.Handler, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("http3 address %q: %w", addr, err)
+	}
+	altSvc := fmt.Sprintf(`h3=":%s"; ma=86400`, port)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// newHTTP3Server builds the HTTP/3 listener served on a UDP socket. QUIC
+// always needs TLS, so it shares the TLS configuration (and SNI
+// certificate selection) of the main listener.
+func newHTTP3Server(tlsConfig *tls.Config, handler http.Handler) *http3.Server {
+	return &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsPerProtocol(t *testing.T) {
+	metrics := newRequestMetrics()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hi", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Hi")
+	})
+	handler, err := advertiseHTTP3(":8443", metrics.middleware(mux))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The TLS client negotiates HTTP/2, a plain transport stays on HTTP/1.1.
+	h2 := srv.Client()
+	tlsConfig := h2.Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	h1 := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+	for _, client := range []*http.Client{h2, h1, h1} {
+		resp, err := client.Get(srv.URL + "/hi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("Alt-Svc"); got != `h3=":8443"; ma=86400` {
+			t.Errorf("unexpected Alt-Svc header %q", got)
+		}
+	}
+
+	var tests = []struct {
+		proto    string
+		requests int64
+	}{
+		{"HTTP/1.1", 2},
+		{"HTTP/2.0", 1},
+	}
+	rows := metrics.snapshot()
+	if len(rows) != len(tests) {
+		t.Fatalf("expected %d metric rows, got %+v", len(tests), rows)
+	}
+	for i, test := range tests {
+		row := rows[i]
+		if row.Proto != test.proto || row.Route != "/hi" || row.Requests != test.requests || row.Bytes != 2*test.requests {
+			t.Errorf("row %d: expected %s /hi x%d, got %+v", i, test.proto, test.requests, row)
+		}
+	}
+}
+
+func TestMetricsRoutePattern(t *testing.T) {
+	metrics := newRequestMetrics()
+	table, err := defaultConfig().build(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	handler := metrics.middleware(table)
+
+	// Both paths are served by the "/" static route, behind the session
+	// middleware.
+	for _, path := range []string{"/style.css", "/no/such/file"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	rows := metrics.snapshot()
+	if len(rows) != 1 || rows[0].Route != "/" || rows[0].Requests != 2 {
+		t.Errorf("expected one row for the / route, got %+v", rows)
+	}
+}
+
+func TestMetricsUnmatchedRequests(t *testing.T) {
+	metrics := newRequestMetrics()
+	cfg := &config{
+		Routes: []routeConfig{{Path: "/hi", Respond: &cannedResponse{Body: "Hi"}}},
+		Hosts:  []hostConfig{{Names: []string{"api.localhost"}, Routes: []routeConfig{{Path: "/", Respond: &cannedResponse{Body: "api"}}}}},
+	}
+	table, err := cfg.build(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	handler := metrics.middleware(table)
+
+	// 404s, POSTs without a CSRF token and, without a default host,
+	// unknown hosts all share one row whatever their paths.
+	for i := 0; i < 20; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/missing/%d", i), nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", fmt.Sprintf("/hi/%d", i), nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hi", nil))
+	cfg.Routes = nil
+	if table, err = cfg.build(metrics); err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	metrics.middleware(table).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://other.localhost/x", nil))
+
+	rows := metrics.snapshot()
+	if len(rows) != 2 || rows[0].Route != unmatchedRoute || rows[0].Requests != 41 || rows[1].Route != "/hi" {
+		t.Errorf("expected one unmatched row and /hi, got %+v", rows)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies understood by proxyConfig.Strategy.
+const (
+	roundRobin       = "round-robin"
+	leastConnections = "least-conn"
+)
+
+// proxyConfig describes one proxied path prefix.
+type proxyConfig struct {
+	Prefix   string   `json:"prefix"`
+	Targets  []string `json:"targets"`
+	Strategy string   `json:"strategy,omitempty"`
+	// StripPrefix removes Prefix from the path before it is sent upstream.
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+
+	// Active health checks: GET HealthPath on every upstream each
+	// HealthInterval. An empty HealthPath disables them.
+	HealthPath     string   `json:"health_path,omitempty"`
+	HealthInterval duration `json:"health_interval,omitempty"`
+
+	// Retries is how many other upstreams an idempotent request is tried on
+	// after a connection error or a 502/503/504. Unset means every other
+	// upstream; 0 turns retries off.
+	Retries *int `json:"retries,omitempty"`
+
+	// After FailureThreshold consecutive failures an upstream's circuit
+	// opens and it gets no traffic for Cooldown; then a single trial request
+	// decides whether it closes again.
+	FailureThreshold int      `json:"failure_threshold,omitempty"`
+	Cooldown         duration `json:"cooldown,omitempty"`
+}
+
+// duration is a time.Duration that reads and writes as "5s" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	*d = duration(v)
+	return err
+}
+
+func (c *proxyConfig) setDefaults() {
+	if c.Strategy == "" {
+		c.Strategy = roundRobin
+	}
+	if c.HealthInterval == 0 {
+		c.HealthInterval = duration(5 * time.Second)
+	}
+	if c.Retries == nil {
+		retries := len(c.Targets) - 1
+		c.Retries = &retries
+	}
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = 3
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = duration(30 * time.Second)
+	}
+}
+
+var errNoUpstream = errors.New("no healthy upstream available")
+
+// upstream is one backend behind a loadBalancer.
+type upstream struct {
+	url     *url.URL
+	active  atomic.Int64
+	healthy atomic.Bool
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// available reports whether the upstream may receive a request now. Once the
+// cooldown of an open circuit is over only one trial request is let through.
+func (u *upstream) available(now time.Time) bool {
+	if !u.healthy.Load() {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(u.openUntil) || u.trial {
+		return false
+	}
+	u.trial = true
+	return true
+}
+
+func (u *upstream) success() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = 0
+	u.openUntil = time.Time{}
+	u.trial = false
+}
+
+// release gives back a trial slot taken by a request that ended without
+// telling whether the upstream works.
+func (u *upstream) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.trial = false
+}
+
+func (u *upstream) failure(threshold int, cooldown time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	if u.trial || u.failures >= threshold {
+		if u.openUntil.IsZero() || u.trial {
+			log.Printf("proxy: circuit open for %s after %d failures", u.url, u.failures)
+		}
+		u.openUntil = time.Now().Add(cooldown)
+		u.trial = false
+	}
+}
+
+// loadBalancer proxies a path prefix to a set of upstreams. It is an
+// httputil.ReverseProxy whose transport picks the upstream, so header
+// handling and response streaming stay the standard library's job.
+type loadBalancer struct {
+	cfg       proxyConfig
+	upstreams []*upstream
+	next      atomic.Uint64
+	transport http.RoundTripper
+	proxy     *httputil.ReverseProxy
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// newLoadBalancer validates cfg and starts the health checks. Call Close to
+// stop them.
+func newLoadBalancer(cfg proxyConfig) (*loadBalancer, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("proxy %s: no targets", cfg.Prefix)
+	}
+	cfg.setDefaults()
+	if cfg.Strategy != roundRobin && cfg.Strategy != leastConnections {
+		return nil, fmt.Errorf("proxy %s: unknown strategy %q", cfg.Prefix, cfg.Strategy)
+	}
+	if *cfg.Retries < 0 {
+		return nil, fmt.Errorf("proxy %s: negative retries", cfg.Prefix)
+	}
+
+	lb := &loadBalancer{
+		cfg:       cfg,
+		transport: http.DefaultTransport,
+		stop:      make(chan struct{}),
+	}
+	for _, target := range cfg.Targets {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %s: %w", cfg.Prefix, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("proxy %s: target %q must be an absolute URL", cfg.Prefix, target)
+		}
+		up := &upstream{url: u}
+		up.healthy.Store(true)
+		lb.upstreams = append(lb.upstreams, up)
+	}
+
+	lb.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+			if cfg.StripPrefix {
+				pr.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(pr.Out.URL.Path, cfg.Prefix), "/")
+				pr.Out.URL.RawPath = ""
+			}
+		},
+		Transport: lb,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("proxy %s: %s %s: %v", cfg.Prefix, r.Method, r.URL.Path, err)
+			if errors.Is(err, errNoUpstream) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	if cfg.HealthPath != "" {
+		go lb.healthChecks()
+	}
+	return lb, nil
+}
+
+func (lb *loadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lb.proxy.ServeHTTP(w, r)
+}
+
+// Close stops the health checks.
+func (lb *loadBalancer) Close() {
+	lb.stopOnce.Do(func() { close(lb.stop) })
+}
+
+// pick chooses an available upstream that is not in tried.
+func (lb *loadBalancer) pick(tried map[*upstream]bool) *upstream {
+	now := time.Now()
+	n := len(lb.upstreams)
+
+	if lb.cfg.Strategy == leastConnections {
+		var best *upstream
+		for _, u := range lb.upstreams {
+			if tried[u] || !u.healthy.Load() {
+				continue
+			}
+			if best == nil || u.active.Load() < best.active.Load() {
+				best = u
+			}
+		}
+		if best != nil && best.available(now) {
+			return best
+		}
+		// The least loaded upstream has an open circuit: fall back to the
+		// first available one.
+	}
+
+	start := int(lb.next.Add(1) - 1)
+	for i := 0; i < n; i++ {
+		u := lb.upstreams[(start+i)%n]
+		if !tried[u] && u.available(now) {
+			return u
+		}
+	}
+	return nil
+}
+
+// RoundTrip sends req to an upstream, retrying idempotent requests without a
+// body on the next upstream when the previous one failed.
+func (lb *loadBalancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := 0
+	if isIdempotent(req.Method) && (req.Body == nil || req.Body == http.NoBody) {
+		retries = *lb.cfg.Retries
+	}
+
+	tried := make(map[*upstream]bool)
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		u := lb.pick(tried)
+		if u == nil {
+			break
+		}
+		tried[u] = true
+
+		out := req.Clone(req.Context())
+		out.URL.Scheme = u.url.Scheme
+		out.URL.Host = u.url.Host
+		out.URL.Path, out.URL.RawPath = joinURLPath(u.url, req.URL)
+		out.Host = ""
+
+		u.active.Add(1)
+		resp, err := lb.transport.RoundTrip(out)
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			u.success()
+			resp.Body = &trackedBody{ReadCloser: resp.Body, u: u}
+			return resp, nil
+		}
+		u.active.Add(-1)
+		if err != nil && req.Context().Err() != nil {
+			// The client went away, which says nothing about the upstream.
+			u.release()
+			return nil, err
+		}
+		u.failure(lb.cfg.FailureThreshold, time.Duration(lb.cfg.Cooldown))
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if attempt == retries {
+			// Out of retries: hand the upstream's error response to the
+			// client rather than hiding it behind our own 502.
+			resp.Body = &trackedBody{ReadCloser: resp.Body, u: u, done: true}
+			return resp, nil
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		lastErr = fmt.Errorf("%s answered %s", u.url, resp.Status)
+	}
+
+	if lastErr == nil {
+		lastErr = errNoUpstream
+	}
+	return nil, lastErr
+}
+
+// healthChecks probes every upstream until Close is called.
+func (lb *loadBalancer) healthChecks() {
+	ticker := time.NewTicker(time.Duration(lb.cfg.HealthInterval))
+	defer ticker.Stop()
+	for {
+		for _, u := range lb.upstreams {
+			healthy := lb.probe(u)
+			if was := u.healthy.Swap(healthy); was != healthy {
+				log.Printf("proxy %s: upstream %s healthy=%v", lb.cfg.Prefix, u.url, healthy)
+			}
+		}
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (lb *loadBalancer) probe(u *upstream) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(lb.cfg.HealthInterval))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url.JoinPath(lb.cfg.HealthPath).String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := lb.transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
+
+// trackedBody keeps the upstream's active connection count up while the
+// response is being streamed to the client.
+type trackedBody struct {
+	io.ReadCloser
+	u    *upstream
+	once sync.Once
+	done bool
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() {
+		if !b.done {
+			b.u.active.Add(-1)
+		}
+	})
+	return b.ReadCloser.Close()
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// joinURLPath joins the upstream base path with the request path, the same
+// way httputil.NewSingleHostReverseProxy does.
+func joinURLPath(base, req *url.URL) (path, rawpath string) {
+	if base.RawPath == "" && req.RawPath == "" {
+		return singleJoiningSlash(base.Path, req.Path), ""
+	}
+	apath := base.EscapedPath()
+	bpath := req.EscapedPath()
+	p := singleJoiningSlash(apath, bpath)
+	path, err := url.PathUnescape(p)
+	if err != nil {
+		return singleJoiningSlash(base.Path, req.Path), ""
+	}
+	return path, p
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// proxyFlags collects repeated -proxy prefix=url1,url2 flags.
+type proxyFlags []proxyConfig
+
+func (p *proxyFlags) String() string {
+	var parts []string
+	for _, c := range *p {
+		parts = append(parts, c.Prefix+"="+strings.Join(c.Targets, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (p *proxyFlags) Set(v string) error {
+	prefix, targets, ok := strings.Cut(v, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("expected /prefix/=http://host:port[,http://host:port...], got %q", v)
+	}
+	*p = append(*p, proxyConfig{Prefix: prefix, Targets: splitHosts(targets)})
+	return nil
+}
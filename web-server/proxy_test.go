@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newUpstream starts a backend that answers with its name and counts hits.
+func newUpstream(t *testing.T, name string, status *atomic.Int32) (*httptest.Server, *atomic.Int32) {
+	hits := &atomic.Int32{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if status != nil && status.Load() != 0 {
+			w.WriteHeader(int(status.Load()))
+			return
+		}
+		io.WriteString(w, name+" "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, hits
+}
+
+func proxyGet(t *testing.T, h http.Handler, method, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+	a, _ := newUpstream(t, "a", nil)
+	b, _ := newUpstream(t, "b", nil)
+	lb, err := newLoadBalancer(proxyConfig{Prefix: "/api/", Targets: []string{a.URL, b.URL}, StripPrefix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	var tests = []string{"a /users", "b /users", "a /users"}
+	for _, expected := range tests {
+		if code, body := proxyGet(t, lb, "GET", "/api/users"); code != 200 || body != expected {
+			t.Errorf("expected 200 %q, got %d %q", expected, code, body)
+		}
+	}
+}
+
+func TestProxyMethodPattern(t *testing.T) {
+	a, _ := newUpstream(t, "a", nil)
+	cfg := &config{
+		Routes:   []routeConfig{{Path: "GET localhost/api/", Proxy: &proxyConfig{Targets: []string{a.URL}, StripPrefix: true}}},
+		Security: &securityConfig{Disabled: true},
+	}
+	table, err := cfg.build(newRequestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.Host = "localhost"
+	rec := httptest.NewRecorder()
+	table.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "a /users" {
+		t.Errorf("expected the prefix stripped, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestProxyRetriesIdempotentOnly(t *testing.T) {
+	var failing atomic.Int32
+	failing.Store(http.StatusServiceUnavailable)
+	bad, badHits := newUpstream(t, "bad", &failing)
+	good, _ := newUpstream(t, "good", nil)
+	lb, err := newLoadBalancer(proxyConfig{Prefix: "/", Targets: []string{bad.URL, good.URL}, FailureThreshold: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	// GET on the failing upstream is retried on the healthy one.
+	if code, body := proxyGet(t, lb, "GET", "/x"); code != 200 || body != "good /x" {
+		t.Errorf("GET: expected retry to succeed, got %d %q", code, body)
+	}
+	// POST is not idempotent: the client sees the upstream error.
+	if code, _ := proxyGet(t, lb, "POST", "/x"); code != http.StatusServiceUnavailable {
+		t.Errorf("POST: expected 503 without retry, got %d", code)
+	}
+	if badHits.Load() != 2 {
+		t.Errorf("expected 2 hits on the failing upstream, got %d", badHits.Load())
+	}
+}
+
+func TestProxyRetriesOff(t *testing.T) {
+	var failing atomic.Int32
+	failing.Store(http.StatusServiceUnavailable)
+	bad, badHits := newUpstream(t, "bad", &failing)
+	good, goodHits := newUpstream(t, "good", nil)
+	retries := 0
+	lb, err := newLoadBalancer(proxyConfig{Prefix: "/", Targets: []string{bad.URL, good.URL}, Retries: &retries, FailureThreshold: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	if code, _ := proxyGet(t, lb, "GET", "/x"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected the 503 without a retry, got %d", code)
+	}
+	if badHits.Load() != 1 || goodHits.Load() != 0 {
+		t.Errorf("expected a single attempt, got %d bad and %d good hits", badHits.Load(), goodHits.Load())
+	}
+
+	retries = -1
+	if _, err := newLoadBalancer(proxyConfig{Prefix: "/", Targets: []string{bad.URL}, Retries: &retries}); err == nil {
+		t.Error("expected an error for negative retries")
+	}
+}
+
+func TestProxyClientCancelIsNotAFailure(t *testing.T) {
+	started := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	lb, err := newLoadBalancer(proxyConfig{Prefix: "/", Targets: []string{slow.URL}, FailureThreshold: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	u := lb.upstreams[0]
+	if !u.available(time.Now()) || u.failures != 0 {
+		t.Errorf("a client hanging up opened the circuit: %d failures", u.failures)
+	}
+}
+
+func TestProxyCircuitBreaker(t *testing.T) {
+	var failing atomic.Int32
+	failing.Store(http.StatusBadGateway)
+	bad, badHits := newUpstream(t, "bad", &failing)
+	lb, err := newLoadBalancer(proxyConfig{Prefix: "/", Targets: []string{bad.URL}, FailureThreshold: 2, Cooldown: duration(50 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	for i := 0; i < 2; i++ {
+		proxyGet(t, lb, "GET", "/")
+	}
+	// Circuit is open: the upstream is not contacted at all.
+	if code, _ := proxyGet(t, lb, "GET", "/"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with open circuit, got %d", code)
+	}
+	if badHits.Load() != 2 {
+		t.Errorf("expected 2 upstream hits, got %d", badHits.Load())
+	}
+
+	// After the cooldown a trial request closes the circuit again.
+	failing.Store(0)
+	time.Sleep(60 * time.Millisecond)
+	if code, body := proxyGet(t, lb, "GET", "/"); code != 200 || body != "bad /" {
+		t.Errorf("expected trial request to succeed, got %d %q", code, body)
+	}
+	if code, _ := proxyGet(t, lb, "GET", "/"); code != 200 {
+		t.Errorf("expected closed circuit, got %d", code)
+	}
+}
+
+func TestProxyHealthChecks(t *testing.T) {
+	var failing atomic.Int32
+	failing.Store(http.StatusInternalServerError)
+	sick, sickHits := newUpstream(t, "sick", &failing)
+	well, _ := newUpstream(t, "well", nil)
+	lb, err := newLoadBalancer(proxyConfig{Prefix: "/", Targets: []string{sick.URL, well.URL}, HealthPath: "/health", HealthInterval: duration(10 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for lb.upstreams[0].healthy.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	probes := sickHits.Load()
+	for i := 0; i < 4; i++ {
+		if code, body := proxyGet(t, lb, "GET", "/"); code != 200 || !strings.HasPrefix(body, "well") {
+			t.Errorf("expected only the healthy upstream, got %d %q", code, body)
+		}
+	}
+	if lb.upstreams[0].healthy.Load() || sickHits.Load() > probes+1 {
+		t.Error("unhealthy upstream still received traffic")
+	}
+}
+
+func TestProxyLeastConnections(t *testing.T) {
+	a, _ := newUpstream(t, "a", nil)
+	b, _ := newUpstream(t, "b", nil)
+	lb, err := newLoadBalancer(proxyConfig{Prefix: "/", Targets: []string{a.URL, b.URL}, Strategy: leastConnections})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+
+	// Pretend "a" is busy with a long download.
+	lb.upstreams[0].active.Add(5)
+	for i := 0; i < 3; i++ {
+		if _, body := proxyGet(t, lb, "GET", "/"); body != "b /" {
+			t.Errorf("expected least loaded upstream b, got %q", body)
+		}
+	}
+	if n := lb.upstreams[1].active.Load(); n != 0 {
+		t.Errorf("expected active count to return to 0, got %d", n)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Graceful restart: on SIGUSR2 the server starts a new copy of its binary
+// with the same arguments and hands it the listening sockets as inherited
+// file descriptors. The new process serves on them right away and reports
+// back through a pipe; only then does the old one stop accepting, finish
+// its in-flight requests and exit. The kernel keeps queuing connections on
+// the shared sockets throughout, so a deploy never refuses one.
+const (
+	// listenersEnv names the inherited sockets in order; the first one is
+	// file descriptor 3.
+	listenersEnv = "WEB_SERVER_LISTENERS"
+	// readyEnv is the descriptor the new process writes to once it serves.
+	readyEnv = "WEB_SERVER_READY_FD"
+)
+
+// sockets opens the process's listening sockets, reusing the ones inherited
+// from a restarting parent, and remembers them to pass them on in turn.
+type sockets struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	open      []namedSocket
+}
+
+type namedSocket struct {
+	name string
+	// *net.TCPListener and *net.UDPConn both hand out a duplicate of their
+	// descriptor.
+	socket interface{ File() (*os.File, error) }
+}
+
+// handoff holds the sockets of this process.
+var handoff = inheritSockets()
+
+func inheritSockets() *sockets {
+	s := &sockets{inherited: make(map[string]*os.File)}
+	if names := os.Getenv(listenersEnv); names != "" {
+		for i, name := range strings.Split(names, ",") {
+			s.inherited[name] = os.NewFile(uintptr(3+i), name)
+		}
+		os.Unsetenv(listenersEnv)
+	}
+	return s
+}
+
+// listen returns the TCP listener called name, inherited or freshly bound
+// to addr.
+func (s *sockets) listen(name, addr string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ln net.Listener
+	var err error
+	if f, ok := s.inherited[name]; ok {
+		delete(s.inherited, name)
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.open = append(s.open, namedSocket{name, ln.(*net.TCPListener)})
+	return ln, nil
+}
+
+// listenPacket is listen for the UDP socket of the HTTP/3 listener.
+func (s *sockets) listenPacket(name, addr string) (net.PacketConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conn net.PacketConn
+	var err error
+	if f, ok := s.inherited[name]; ok {
+		delete(s.inherited, name)
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.open = append(s.open, namedSocket{name, conn.(*net.UDPConn)})
+	return conn, nil
+}
+
+// ready tells the parent, if this process was started by a restart, that
+// it is serving. Inherited sockets nobody asked for (a flag was dropped)
+// are closed.
+func (s *sockets) ready() {
+	s.mu.Lock()
+	for name, f := range s.inherited {
+		f.Close()
+		delete(s.inherited, name)
+	}
+	s.mu.Unlock()
+
+	fd, err := strconv.Atoi(os.Getenv(readyEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(readyEnv)
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// restart starts the new process with the open sockets and waits until it
+// is ready. On error the new process is gone and the current one should
+// carry on.
+func (s *sockets) restart(timeout time.Duration) error {
+	s.mu.Lock()
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, o := range s.open {
+		f, err := o.socket.File()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		names = append(names, o.name)
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// os.Args[0] rather than os.Executable: a deploy replaces the binary
+	// at its path and the new process must run the new one.
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+strings.Join(names, ","),
+		fmt.Sprintf("%s=%d", readyEnv, 3+len(files)),
+	)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	// The read ends with EOF if the process exits without being ready.
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Wait()
+			return errors.New("new process exited before it was ready")
+		}
+		go cmd.Wait()
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process not ready after %v", timeout)
+	}
+}
+
+// restartOnSignal hands the sockets to a new process on SIGUSR2 and, once
+// it is ready, calls drain and returns. A failed restart keeps this process
+// serving.
+func restartOnSignal(s *sockets, drain func()) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		log.Printf("restart: starting a new process")
+		if err := s.restart(30 * time.Second); err != nil {
+			log.Printf("restart: %v (keeping current process)", err)
+			continue
+		}
+		signal.Stop(usr2)
+		log.Printf("restart: new process ready, draining connections")
+		drain()
+		return
+	}
+}
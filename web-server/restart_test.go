@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestRestartChild is the new process started by TestRestart: it serves one
+// request on the inherited listener and exits.
+func TestRestartChild(t *testing.T) {
+	mode := os.Getenv("WEB_SERVER_TEST_CHILD")
+	if mode == "" {
+		t.Skip("only runs as the child of TestRestart")
+	}
+	if mode == "fail" {
+		os.Exit(1)
+	}
+	ln, err := handoff.listen("main", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new process")
+		close(served)
+	})}
+	go srv.Serve(ln)
+	handoff.ready()
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+	}
+	srv.Close()
+}
+
+func TestRestart(t *testing.T) {
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestRestartChild$"}
+	defer func() { os.Args = args }()
+
+	s := &sockets{inherited: map[string]*os.File{}}
+	ln, err := s.listen("main", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	t.Setenv("WEB_SERVER_TEST_CHILD", "fail")
+	if err := s.restart(10 * time.Second); err == nil {
+		t.Fatal("expected an error when the new process exits early")
+	}
+
+	t.Setenv("WEB_SERVER_TEST_CHILD", "serve")
+	if err := s.restart(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// The old process stops accepting; the socket stays open in the new
+	// one, so the next connection is served there.
+	addr := ln.Addr().String()
+	ln.Close()
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "new process" {
+		t.Errorf("expected the new process to answer, got %q", body)
+	}
+}
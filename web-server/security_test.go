@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	h := newSecurityHeaders(&securityConfig{FrameOptions: "SAMEORIGIN", ReferrerPolicy: "-"}).wrap(&cannedResponse{Body: "Hi"})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/hi", nil))
+	var tests = []struct {
+		header   string
+		expected string
+	}{
+		{"Content-Security-Policy", "default-src 'self'"},
+		{"X-Content-Type-Options", "nosniff"},
+		{"X-Frame-Options", "SAMEORIGIN"},
+		{"Referrer-Policy", ""},
+		{"Strict-Transport-Security", ""},
+	}
+	for _, test := range tests {
+		if got := rec.Header().Get(test.header); got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.header, test.expected, got)
+		}
+	}
+
+	// HSTS is only sent over TLS.
+	req := httptest.NewRequest("GET", "/hi", nil)
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "max-age=15552000" {
+		t.Errorf("expected HSTS over TLS, got %q", got)
+	}
+	cookie := rec.Result().Cookies()[0]
+	if !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("expected a Secure SameSite=Strict CSRF cookie, got %+v", cookie)
+	}
+}
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	h := newSecurityHeaders(&securityConfig{CSRF: csrfConfig{Exempt: []string{"/api/"}}}).wrap(&cannedResponse{Body: "ok"})
+
+	// A GET hands out the token.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf_token" || cookies[0].Value == "" {
+		t.Fatalf("expected a csrf_token cookie, got %v", cookies)
+	}
+	token := cookies[0].Value
+
+	form := url.Values{"csrf_token": {token}}.Encode()
+	var tests = []struct {
+		name   string
+		path   string
+		cookie string
+		header string
+		form   string
+		status int
+	}{
+		{"no cookie", "/increment", "", token, "", 403},
+		{"no header", "/increment", token, "", "", 403},
+		{"mismatch", "/increment", token, "forged", "", 403},
+		{"header", "/increment", token, token, "", 200},
+		{"form field", "/increment", token, "", form, 200},
+		{"exempt", "/api/items", "", "", "", 200},
+	}
+	for _, test := range tests {
+		var req *http.Request
+		if test.form != "" {
+			req = httptest.NewRequest("POST", test.path, strings.NewReader(test.form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest("POST", test.path, nil)
+		}
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "csrf_token", Value: test.cookie})
+		}
+		if test.header != "" {
+			req.Header.Set("X-CSRF-Token", test.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, rec.Code)
+		}
+	}
+}
+
+func TestStaticPagesFollowDefaultPolicy(t *testing.T) {
+	// default-src 'self' blocks inline styles and scripts, so the pages
+	// must load theirs from files.
+	pages, _ := filepath.Glob("static/*.html")
+	admin, _ := filepath.Glob("admin/*.html")
+	if pages = append(pages, admin...); len(pages) == 0 {
+		t.Fatal("no pages")
+	}
+	for _, page := range pages {
+		data, err := os.ReadFile(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if html := string(data); strings.Contains(html, "<style") || strings.Contains(html, "<script>") || strings.Contains(html, " style=") {
+			t.Errorf("%s has inline styles or scripts", page)
+		}
+	}
+}
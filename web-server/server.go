@@ -1,38 +1,269 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
 )
 
-var counter int
+// counters holds the named counters used by "counter" routes. They live
+// outside the route table so a config reload doesn't reset them.
+var counters = map[string]*counterState{}
 var mutex = &sync.Mutex{}
 
+// counterState is a counter's value plus a version that grows by one on
+// every change, so clients can tell updates apart even when ?by=N makes
+// the value jump.
+type counterState struct {
+	Name    string `json:"name"`
+	Value   int    `json:"value"`
+	Version uint64 `json:"version"`
+}
+
 func echoString(w http.ResponseWriter, r *http.Request) {
-    fmt.Fprintf(w, "hello")
+	fmt.Fprintf(w, "hello")
+}
+
+// incrementCounter serves a counter route: POST adds ?by=N (default 1) and
+// GET/HEAD only read, both answering with the counter as JSON. Mutating on
+// GET would let link prefetchers and crawlers bump the counter.
+func incrementCounter(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		by, ok := counterIncrement(w, r)
+		if !ok {
+			return
+		}
+
+		mutex.Lock()
+		c, ok := counters[name]
+		if !ok {
+			c = &counterState{Name: name}
+			counters[name] = c
+		}
+		if by != 0 {
+			c.Value += by
+			c.Version++
+			counterEvents.publish(*c)
+		}
+		state := *c
+		mutex.Unlock()
+
+		writeCounter(w, state)
+	}
+}
+
+// counterIncrement returns how much a counter request adds: 0 for reads,
+// ?by=N (default 1) for POST. On any other method or a bad N it answers the
+// request itself and returns ok=false.
+func counterIncrement(w http.ResponseWriter, r *http.Request) (by int, ok bool) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return 0, true
+	case http.MethodPost:
+		v := r.URL.Query().Get("by")
+		if v == "" {
+			return 1, true
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "by must be a positive integer", http.StatusBadRequest)
+			return 0, false
+		}
+		return n, true
+	}
+	w.Header().Set("Allow", "GET, HEAD, POST")
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return 0, false
 }
 
-func incrementCounter(w http.ResponseWriter, r *http.Request) {
-    mutex.Lock()
-    counter++
-    fmt.Fprintf(w, strconv.Itoa(counter))
-    mutex.Unlock()
+func writeCounter(w http.ResponseWriter, state counterState) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(state)
+}
+
+// counterValue returns the current state of the named counter.
+func counterValue(name string) counterState {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if c, ok := counters[name]; ok {
+		return *c
+	}
+	return counterState{Name: name}
+}
+
+// counterValues returns a copy of all counters.
+func counterValues() map[string]int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	values := make(map[string]int, len(counters))
+	for name, c := range counters {
+		values[name] = c.Value
+	}
+	return values
 }
 
 func main() {
+	// `web-server certs ...` manages the local development CA and
+	// certificates instead of starting the server.
+	if len(os.Args) > 1 && os.Args[1] == "certs" {
+		if err := runCerts(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	configFile := flag.String("config", "", "JSON route configuration, e.g. routes.json (reloaded on SIGHUP)")
+	addr := flag.String("addr", ":8081", "address to listen on")
+	certFile := flag.String("cert", "", "TLS certificate file, e.g. certs/server.crt (enables HTTPS)")
+	keyFile := flag.String("key", "", "TLS private key file, e.g. certs/server.key")
+	h2c := flag.Bool("h2c", false, "accept HTTP/2 over cleartext (prior knowledge) when TLS is off")
+	http3Addr := flag.String("http3", "", "UDP address of an optional HTTP/3 (QUIC) listener, e.g. :8443; requires -cert and -key")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long a process replaced by a restart (SIGUSR2) waits for in-flight requests")
+	adminAddr := flag.String("admin", "", "address of the admin listener with stats, dashboard and pprof, e.g. 127.0.0.1:8082 (disabled when empty)")
+	dev := flag.Bool("dev", false, "development mode: read templates from ./templates and reload pages when they change")
+	var proxies proxyFlags
+	flag.Var(&proxies, "proxy", "proxy a path prefix to upstreams, e.g. /api/=http://127.0.0.1:9001,http://127.0.0.1:9002 (repeatable)")
+	strategy := flag.String("lb", roundRobin, "load balancing strategy for -proxy: round-robin or least-conn")
+	healthPath := flag.String("proxy-health", "/", "path probed on every -proxy upstream for active health checks (empty disables)")
+	flag.Parse()
+	useTLS := *certFile != "" || *keyFile != ""
 
-    http.Handle("/", http.FileServer(http.Dir("./static")))
+	metrics := newRequestMetrics()
 
-    http.HandleFunc("/increment", incrementCounter)
+	// Routes come from the config file (or the built-in defaults) plus any
+	// -proxy flags.
+	load := func() (*config, error) {
+		cfg := defaultConfig()
+		if *configFile != "" {
+			var err error
+			if cfg, err = loadConfig(*configFile); err != nil {
+				return nil, err
+			}
+		}
+		if *dev {
+			if cfg.Templates == nil {
+				cfg.Templates = &templateConfig{}
+			}
+			cfg.Templates.Dev = true
+		}
+		for _, p := range proxies {
+			p.Strategy = *strategy
+			p.HealthPath = *healthPath
+			cfg.Routes = append(cfg.Routes, routeConfig{Path: p.Prefix, Proxy: &p})
+		}
+		return cfg, nil
+	}
+	cfg, err := load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	table, err := cfg.build(metrics)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rt := &router{}
+	rt.swap(table)
+	go reloadOnSignal(rt, load, metrics)
 
-    http.HandleFunc("/hi", func(w http.ResponseWriter, r *http.Request){
-        fmt.Fprintf(w, "Hi")
-    })
+	handler := metrics.middleware(rt)
+	if *http3Addr != "" {
+		if !useTLS {
+			log.Fatal("-http3 requires -cert and -key")
+		}
+		if handler, err = advertiseHTTP3(*http3Addr, handler); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-    log.Fatal(http.ListenAndServe(":8081", nil))
-    //log.Fatal(http.ListenAndServeTLS(":443", "server.crt", "server.key", nil))
+	srv := newServer(*addr, handler, *h2c)
+	conns := newConnTracker()
+	srv.ConnState = conns.track
+	srv.RegisterOnShutdown(counterEvents.close)
+	ln, err := handoff.listen("main", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-}
\ No newline at end of file
+	var admin *http.Server
+	if *adminAddr != "" {
+		admin = &http.Server{Addr: *adminAddr, Handler: adminHandler(metrics, conns)}
+		adminLn, err := handoff.listen("admin", *adminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := admin.Serve(adminLn); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if useTLS {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Virtual hosts with their own certificate are picked by SNI, all
+		// others get the -cert/-key pair.
+		srv.TLSConfig = &tls.Config{
+			Certificates:   []tls.Certificate{cert},
+			GetCertificate: rt.getCertificate,
+		}
+	}
+	var h3 *http3.Server
+	var h3Conn net.PacketConn
+	if *http3Addr != "" {
+		if h3Conn, err = handoff.listenPacket("http3", *http3Addr); err != nil {
+			log.Fatal(err)
+		}
+		h3 = newHTTP3Server(srv.TLSConfig.Clone(), handler)
+		go func() {
+			if err := h3.Serve(h3Conn); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	drained := make(chan struct{})
+	go restartOnSignal(handoff, func() {
+		defer close(drained)
+		// The new process reads the shared UDP socket now, so QUIC
+		// connections can't be drained; their clients reconnect to it.
+		if h3 != nil {
+			h3.Close()
+			h3Conn.Close()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if admin != nil {
+			admin.Shutdown(ctx)
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("restart: %v", err)
+		}
+	})
+	handoff.ready()
+
+	if useTLS {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-drained
+	log.Printf("restart: connections drained, exiting")
+}
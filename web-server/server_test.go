@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// resetCounter removes the global counter name when the test ends, so the
+// test starts from zero when run again (-count).
+func resetCounter(t *testing.T, name string) {
+	t.Cleanup(func() {
+		mutex.Lock()
+		delete(counters, name)
+		mutex.Unlock()
+	})
+}
+
+func TestIncrementCounter(t *testing.T) {
+	resetCounter(t, "increment-test")
+	h := incrementCounter("increment-test")
+
+	var tests = []struct {
+		method  string
+		target  string
+		status  int
+		value   int
+		version uint64
+	}{
+		{"GET", "/increment", 200, 0, 0},
+		{"POST", "/increment", 200, 1, 1},
+		{"GET", "/increment", 200, 1, 1},
+		{"HEAD", "/increment", 200, 1, 1},
+		{"POST", "/increment?by=5", 200, 6, 2},
+		{"POST", "/increment?by=0", 400, 6, 2},
+		{"POST", "/increment?by=x", 400, 6, 2},
+		{"PUT", "/increment", 405, 6, 2},
+		{"DELETE", "/increment", 405, 6, 2},
+		{"GET", "/increment", 200, 6, 2},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(test.method, test.target, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.target, test.status, rec.Code)
+			continue
+		}
+		if rec.Code == 405 && rec.Header().Get("Allow") != "GET, HEAD, POST" {
+			t.Errorf("%s: unexpected Allow header %q", test.method, rec.Header().Get("Allow"))
+		}
+		if rec.Code != 200 {
+			continue
+		}
+		var c counterState
+		if err := json.Unmarshal(rec.Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		if c.Name != "increment-test" || c.Value != test.value || c.Version != test.version {
+			t.Errorf("%s %s: expected value %d version %d, got %+v", test.method, test.target, test.value, test.version, c)
+		}
+	}
+}
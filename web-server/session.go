@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionConfig selects the session store and expiry. Sessions are always
+// available to handlers; a cookie is only sent once a handler stores a
+// value.
+type sessionConfig struct {
+	// Store is "memory" (the default), "file" or "cookie".
+	Store      string `json:"store,omitempty"`
+	CookieName string `json:"cookie_name,omitempty"`
+	// Dir is where the file store keeps one JSON file per session.
+	Dir string `json:"dir,omitempty"`
+	// Secret keys the cookie store. Without one a random key is used and
+	// sessions don't survive a restart.
+	Secret string `json:"secret,omitempty"`
+	// Encrypt makes the cookie store encrypt the session (AES-GCM) instead
+	// of only signing it (HMAC-SHA256).
+	Encrypt bool `json:"encrypt,omitempty"`
+	// IdleTimeout ends a session that saw no request for this long,
+	// AbsoluteTimeout ends it this long after it was created.
+	IdleTimeout     duration `json:"idle_timeout,omitempty"`
+	AbsoluteTimeout duration `json:"absolute_timeout,omitempty"`
+}
+
+// session is the per-visitor state handlers read and write through
+// sessionFrom(r.Context()).
+type session struct {
+	ID       string            `json:"id"`
+	Values   map[string]string `json:"values"`
+	Created  time.Time         `json:"created"`
+	LastSeen time.Time         `json:"last_seen"`
+
+	mu      sync.Mutex
+	dirty   bool
+	renew   bool
+	destroy bool
+}
+
+func (s *session) Get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Values[key]
+}
+
+func (s *session) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Values[key] = value
+	s.dirty = true
+}
+
+func (s *session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Values, key)
+	s.dirty = true
+}
+
+// RenewID gives the session a new ID when the response is sent, keeping its
+// values. Call it whenever the visitor's privileges change (login, logout,
+// role change) so a session ID planted or leaked earlier becomes useless.
+func (s *session) RenewID() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renew = true
+	s.dirty = true
+}
+
+// Destroy removes the session and its cookie.
+func (s *session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.destroy = true
+}
+
+// sessionStore persists sessions. The cookie value is whatever the store
+// needs to find the session again: an ID for server-side stores, the whole
+// session for the cookie store.
+type sessionStore interface {
+	load(cookie string) (*session, error)
+	save(s *session) (cookie string, err error)
+	delete(s *session) error
+	// sweep removes the stored sessions expired reports true for.
+	sweep(expired func(*session) bool) error
+}
+
+type sessionKey struct{}
+
+// sessionFrom returns the session of the request. It is never nil behind
+// the session middleware.
+func sessionFrom(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+// sessionManager loads the session before the handler runs and saves it,
+// setting the cookie, right before the response headers go out.
+type sessionManager struct {
+	store      sessionStore
+	cookieName string
+	idle       time.Duration
+	absolute   time.Duration
+	now        func() time.Time
+
+	// lastSweep is when expired sessions were last removed from the store.
+	sweepMu   sync.Mutex
+	lastSweep time.Time
+}
+
+// memorySessions is shared by every route table so a config reload keeps
+// the sessions of the memory store.
+var memorySessions = &memorySessionStore{sessions: make(map[string]*session)}
+
+// fallbackSecret keys cookie sessions when no secret is configured. It is
+// made once per process so a config reload doesn't log everyone out.
+var fallbackSecret = sync.OnceValue(func() []byte {
+	log.Print("sessions: no secret configured, cookie sessions won't survive a restart")
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+})
+
+func newSessionManager(cfg *sessionConfig) (*sessionManager, error) {
+	if cfg == nil {
+		cfg = &sessionConfig{}
+	}
+	m := &sessionManager{
+		cookieName: cfg.CookieName,
+		idle:       time.Duration(cfg.IdleTimeout),
+		absolute:   time.Duration(cfg.AbsoluteTimeout),
+		now:        time.Now,
+	}
+	if m.cookieName == "" {
+		m.cookieName = "session"
+	}
+	if m.idle == 0 {
+		m.idle = 30 * time.Minute
+	}
+	if m.absolute == 0 {
+		m.absolute = 24 * time.Hour
+	}
+
+	switch cfg.Store {
+	case "", "memory":
+		m.store = memorySessions
+	case "file":
+		dir := cfg.Dir
+		if dir == "" {
+			dir = "sessions"
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		m.store = &fileSessionStore{dir: dir}
+	case "cookie":
+		secret := []byte(cfg.Secret)
+		if len(secret) == 0 {
+			secret = fallbackSecret()
+		}
+		key := sha256.Sum256(secret)
+		m.store = &cookieSessionStore{key: key[:], encrypt: cfg.Encrypt}
+	default:
+		return nil, fmt.Errorf("sessions: unknown store %q", cfg.Store)
+	}
+	return m, nil
+}
+
+func (m *sessionManager) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.sweepIfDue(m.now())
+		s, existing := m.load(r)
+		sw := &sessionWriter{ResponseWriter: w, commit: func() { m.commit(w, r, s, existing) }}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), sessionKey{}, s)))
+		sw.commitOnce()
+	})
+}
+
+// load returns the request's session, or a fresh one when there is none or
+// it expired. existing reports whether it came from the store.
+func (m *sessionManager) load(r *http.Request) (s *session, existing bool) {
+	now := m.now()
+	if c, err := r.Cookie(m.cookieName); err == nil {
+		s, err := m.store.load(c.Value)
+		if err == nil && s != nil {
+			if !m.expired(s, now) {
+				return s, true
+			}
+			m.store.delete(s)
+		}
+	}
+	return &session{ID: newSessionID(), Values: map[string]string{}, Created: now, LastSeen: now}, false
+}
+
+func (m *sessionManager) expired(s *session, now time.Time) bool {
+	return now.Sub(s.LastSeen) >= m.idle || now.Sub(s.Created) >= m.absolute
+}
+
+// sweepIfDue removes expired sessions in the background, once per idle
+// timeout. Sessions whose visitor never comes back are never loaded, so
+// load alone would keep them forever.
+func (m *sessionManager) sweepIfDue(now time.Time) {
+	m.sweepMu.Lock()
+	due := now.Sub(m.lastSweep) >= m.idle
+	if due {
+		m.lastSweep = now
+	}
+	m.sweepMu.Unlock()
+	if due {
+		go func() {
+			if err := m.sweep(now); err != nil {
+				log.Printf("sessions: sweep: %v", err)
+			}
+		}()
+	}
+}
+
+// sweep removes the sessions expired at now from the store.
+func (m *sessionManager) sweep(now time.Time) error {
+	return m.store.sweep(func(s *session) bool { return m.expired(s, now) })
+}
+
+// commit saves the session and sets or clears the cookie.
+func (m *sessionManager) commit(w http.ResponseWriter, r *http.Request, s *session, existing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := m.now()
+	if s.destroy {
+		if existing {
+			m.store.delete(s)
+			http.SetCookie(w, &http.Cookie{Name: m.cookieName, Path: "/", MaxAge: -1})
+		}
+		return
+	}
+	// Bump the idle timer at most once a minute to spare the store a write
+	// per request.
+	touch := existing && now.Sub(s.LastSeen) > time.Minute
+	if !s.dirty && !touch {
+		return
+	}
+	if s.renew && existing {
+		m.store.delete(s)
+		s.ID = newSessionID()
+	}
+	s.LastSeen = now
+	value, err := m.store.save(s)
+	if err != nil {
+		log.Printf("sessions: save: %v", err)
+		return
+	}
+	s.dirty, s.renew = false, false
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.cookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  s.Created.Add(m.absolute),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionWriter commits the session just before the first byte of the
+// response, the last moment a cookie can still be set.
+type sessionWriter struct {
+	http.ResponseWriter
+	commit func()
+	done   bool
+}
+
+func (w *sessionWriter) commitOnce() {
+	if !w.done {
+		w.done = true
+		w.commit()
+	}
+}
+
+func (w *sessionWriter) WriteHeader(status int) {
+	w.commitOnce()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	w.commitOnce()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends the headers, so the session is saved first.
+func (w *sessionWriter) Flush() {
+	w.commitOnce()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *sessionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack saves the session before the connection is taken over; the cookie
+// can't be updated on an upgraded connection.
+func (w *sessionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.commitOnce()
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var errBadSession = errors.New("sessions: invalid session cookie")
+
+// memorySessionStore keeps sessions in the process.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func (st *memorySessionStore) load(id string) (*session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	return s.clone(), nil
+}
+
+func (st *memorySessionStore) save(s *session) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sessions[s.ID] = s.clone()
+	return s.ID, nil
+}
+
+func (st *memorySessionStore) delete(s *session) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, s.ID)
+	return nil
+}
+
+func (st *memorySessionStore) sweep(expired func(*session) bool) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id, s := range st.sessions {
+		if expired(s) {
+			delete(st.sessions, id)
+		}
+	}
+	return nil
+}
+
+// clone copies the persistent fields so the store never shares a map with
+// a request. The caller must hold s.mu when s is in use by a request.
+func (s *session) clone() *session {
+	c := &session{ID: s.ID, Values: make(map[string]string, len(s.Values)), Created: s.Created, LastSeen: s.LastSeen}
+	for k, v := range s.Values {
+		c.Values[k] = v
+	}
+	return c
+}
+
+// fileSessionStore keeps one JSON file per session in dir.
+type fileSessionStore struct {
+	dir string
+}
+
+func (st *fileSessionStore) path(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return "", errBadSession
+	}
+	return filepath.Join(st.dir, id+".json"), nil
+}
+
+func (st *fileSessionStore) load(id string) (*session, error) {
+	path, err := st.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (st *fileSessionStore) save(s *session) (string, error) {
+	path, err := st.path(s.ID)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	// Write to a temporary file and rename so a concurrent load never
+	// reads half a session. Each save gets its own file: two requests of
+	// the same session may save at once.
+	tmp, err := os.CreateTemp(st.dir, ".session-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return s.ID, nil
+}
+
+func (st *fileSessionStore) delete(s *session) error {
+	path, err := st.path(s.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (st *fileSessionStore) sweep(expired func(*session) bool) error {
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		s, err := st.load(id)
+		if err != nil || s == nil || !expired(s) {
+			continue
+		}
+		if err := st.delete(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cookieSessionStore keeps the whole session in the cookie, signed with
+// HMAC-SHA256 or encrypted with AES-256-GCM. Keep the values small:
+// browsers cap cookies at about 4KB.
+type cookieSessionStore struct {
+	key     []byte
+	encrypt bool
+}
+
+func (st *cookieSessionStore) load(value string) (*session, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errBadSession
+	}
+	if st.encrypt {
+		gcm, err := st.gcm()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < gcm.NonceSize() {
+			return nil, errBadSession
+		}
+		data, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+		if err != nil {
+			return nil, errBadSession
+		}
+	} else {
+		if len(data) < sha256.Size {
+			return nil, errBadSession
+		}
+		payload, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+		if !hmac.Equal(sum, st.sign(payload)) {
+			return nil, errBadSession
+		}
+		data = payload
+	}
+	var s session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errBadSession
+	}
+	return &s, nil
+}
+
+func (st *cookieSessionStore) save(s *session) (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	if st.encrypt {
+		gcm, err := st.gcm()
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		data = gcm.Seal(nonce, nonce, data, nil)
+	} else {
+		data = append(data, st.sign(data)...)
+	}
+	value := base64.RawURLEncoding.EncodeToString(data)
+	if len(value) > 4000 {
+		return "", fmt.Errorf("sessions: cookie session too large (%d bytes)", len(value))
+	}
+	return value, nil
+}
+
+// delete can't revoke a cookie that was already handed out; the expiry
+// times inside it still bound its lifetime.
+func (st *cookieSessionStore) delete(s *session) error {
+	return nil
+}
+
+// sweep has nothing to do: cookie sessions are kept by the browsers.
+func (st *cookieSessionStore) sweep(expired func(*session) bool) error {
+	return nil
+}
+
+func (st *cookieSessionStore) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, st.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (st *cookieSessionStore) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(st.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sessionCounter serves a counter kept in the visitor's session, with the
+// same methods and JSON as the global counters.
+func sessionCounter(name string) http.HandlerFunc {
+	key := "counter:" + name
+	return func(w http.ResponseWriter, r *http.Request) {
+		by, ok := counterIncrement(w, r)
+		if !ok {
+			return
+		}
+		s := sessionFrom(r.Context())
+		var state counterState
+		if v := s.Get(key); v != "" {
+			json.Unmarshal([]byte(v), &state)
+		}
+		state.Name = name
+		if by != 0 {
+			state.Value += by
+			state.Version++
+			data, _ := json.Marshal(state)
+			s.Set(key, string(data))
+		}
+		writeCounter(w, state)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionClient replays the session cookie across requests like a browser.
+type sessionClient struct {
+	handler http.Handler
+	cookie  *http.Cookie
+}
+
+func (c *sessionClient) do(method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if c.cookie != nil {
+		req.AddCookie(c.cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			c.cookie = nil
+		} else {
+			c.cookie = cookie
+		}
+	}
+	return rec
+}
+
+func newTestSessions(t *testing.T, cfg *sessionConfig) *sessionManager {
+	m, err := newSessionManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Store == "" || cfg.Store == "memory" {
+		m.store = &memorySessionStore{sessions: make(map[string]*session)}
+	}
+	return m
+}
+
+func TestSessionStores(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  *sessionConfig
+	}{
+		{"memory", &sessionConfig{}},
+		{"file", &sessionConfig{Store: "file", Dir: t.TempDir()}},
+		{"signed cookie", &sessionConfig{Store: "cookie", Secret: "secret"}},
+		{"encrypted cookie", &sessionConfig{Store: "cookie", Secret: "secret", Encrypt: true}},
+	}
+	for _, test := range tests {
+		m := newTestSessions(t, test.cfg)
+		c := &sessionClient{handler: m.middleware(sessionCounter("visits"))}
+
+		if c.do("GET", "/"); c.cookie != nil {
+			t.Errorf("%s: cookie set by a read-only request", test.name)
+		}
+		for i := 1; i <= 3; i++ {
+			rec := c.do("POST", "/")
+			var state counterState
+			json.Unmarshal(rec.Body.Bytes(), &state)
+			if state.Value != i {
+				t.Errorf("%s: expected %d, got %d", test.name, i, state.Value)
+			}
+		}
+		if c.cookie == nil || !c.cookie.HttpOnly {
+			t.Errorf("%s: expected an HttpOnly session cookie, got %v", test.name, c.cookie)
+		}
+
+		other := &sessionClient{handler: c.handler}
+		var state counterState
+		json.Unmarshal(other.do("POST", "/").Body.Bytes(), &state)
+		if state.Value != 1 {
+			t.Errorf("%s: new visitor saw %d, expected 1", test.name, state.Value)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		name    string
+		step    time.Duration // between requests
+		steps   int
+		expired bool
+	}{
+		{"active", 10 * time.Minute, 3, false},
+		{"idle", 31 * time.Minute, 1, true},
+		{"absolute", 20 * time.Minute, 80, true},
+	}
+	for _, test := range tests {
+		m := newTestSessions(t, &sessionConfig{
+			IdleTimeout:     duration(30 * time.Minute),
+			AbsoluteTimeout: duration(24 * time.Hour),
+		})
+		clock := now
+		m.now = func() time.Time { return clock }
+		handler := m.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s := sessionFrom(r.Context())
+			if r.Method == "POST" {
+				s.Set("user", "alice")
+			}
+			w.Write([]byte(s.Get("user")))
+		}))
+		c := &sessionClient{handler: handler}
+		c.do("POST", "/")
+
+		var got string
+		for i := 0; i < test.steps; i++ {
+			clock = clock.Add(test.step)
+			got = c.do("GET", "/").Body.String()
+		}
+		if expired := got == ""; expired != test.expired {
+			t.Errorf("%s: expected expired=%v, got %q", test.name, test.expired, got)
+		}
+	}
+}
+
+func TestSessionRenewID(t *testing.T) {
+	m := newTestSessions(t, &sessionConfig{})
+	handler := m.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := sessionFrom(r.Context())
+		switch r.URL.Path {
+		case "/visit":
+			s.Set("visited", "yes")
+		case "/login":
+			s.Set("user", "alice")
+			s.RenewID()
+		case "/logout":
+			s.Destroy()
+		}
+		w.Write([]byte(s.Get("visited") + "," + s.Get("user")))
+	}))
+	c := &sessionClient{handler: handler}
+
+	c.do("GET", "/visit")
+	before := c.cookie
+	c.do("GET", "/login")
+	if c.cookie == nil || c.cookie.Value == before.Value {
+		t.Fatalf("session ID not rotated on login: %v -> %v", before, c.cookie)
+	}
+	if body := c.do("GET", "/").Body.String(); body != "yes,alice" {
+		t.Errorf("values lost on rotation: %q", body)
+	}
+
+	// The pre-login ID must no longer work.
+	stale := &sessionClient{handler: handler, cookie: before}
+	if body := stale.do("GET", "/").Body.String(); body != "," {
+		t.Errorf("old session ID still valid: %q", body)
+	}
+
+	c.do("GET", "/logout")
+	if c.cookie != nil {
+		t.Errorf("cookie not cleared on logout: %v", c.cookie)
+	}
+}
+
+func TestCookieSessionTampering(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		st := &cookieSessionStore{key: make([]byte, 32), encrypt: encrypt}
+		value, err := st.save(&session{ID: newSessionID(), Values: map[string]string{"role": "user"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.load(value); err != nil {
+			t.Errorf("encrypt=%v: valid cookie rejected: %v", encrypt, err)
+		}
+
+		data, _ := base64.RawURLEncoding.DecodeString(value)
+		data[len(data)/2] ^= 1
+		flipped := base64.RawURLEncoding.EncodeToString(data)
+		for _, bad := range []string{flipped, "x" + value, "", "!!!"} {
+			if _, err := st.load(bad); err == nil {
+				t.Errorf("encrypt=%v: tampered cookie %q accepted", encrypt, bad)
+			}
+		}
+		other := &cookieSessionStore{key: []byte(strings.Repeat("k", 32)), encrypt: encrypt}
+		if _, err := other.load(value); err == nil {
+			t.Errorf("encrypt=%v: cookie accepted under another key", encrypt)
+		}
+	}
+}
+
+func TestSessionSweep(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, cfg := range []*sessionConfig{{}, {Store: "file", Dir: t.TempDir()}} {
+		m := newTestSessions(t, cfg)
+		save := func(id string, lastSeen time.Time) {
+			if _, err := m.store.save(&session{ID: id, Values: map[string]string{}, Created: now, LastSeen: lastSeen}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		idle, active := newSessionID(), newSessionID()
+		save(idle, now)
+		save(active, now.Add(time.Hour))
+
+		if err := m.sweep(now.Add(61 * time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		for id, name := range map[string]string{idle: "idle", active: "active"} {
+			s, err := m.store.load(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := s != nil; kept != (name == "active") {
+				t.Errorf("store %q: the %s session was kept=%v", cfg.Store, name, kept)
+			}
+		}
+	}
+}
+
+func TestCookieSessionFallbackSecret(t *testing.T) {
+	// A reload builds a new manager; cookies handed out before must still
+	// be valid.
+	cfg := &sessionConfig{Store: "cookie"}
+	before := newTestSessions(t, cfg)
+	value, err := before.store.save(&session{ID: newSessionID(), Values: map[string]string{"user": "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := newTestSessions(t, cfg)
+	if s, err := after.store.load(value); err != nil || s.Values["user"] != "alice" {
+		t.Errorf("cookie rejected after a reload: %v", err)
+	}
+}
+
+func TestFileSessionConcurrentSave(t *testing.T) {
+	dir := t.TempDir()
+	m := newTestSessions(t, &sessionConfig{Store: "file", Dir: dir})
+	id := newSessionID()
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := m.store.save(&session{ID: id, Values: map[string]string{"n": strconv.Itoa(i)}})
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != id+".json" {
+		t.Errorf("expected only the session file, got %v", entries)
+	}
+}
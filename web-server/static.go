@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// staticHandler serves files from root like http.FileServer, adding a
+// strong ETag built from the file's size and modification time.
+// http.ServeContent already answers Range requests; the ETag is what lets
+// clients resuming a large download use If-Range safely, since a
+// Last-Modified date only has one second resolution.
+func staticHandler(root string) http.Handler {
+	fs := http.Dir(root)
+	files := http.FileServer(fs)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		if f, err := fs.Open(path.Clean(name)); err == nil {
+			if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+				w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+			}
+			f.Close()
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,34 @@
+const value = document.getElementById("value");
+const status = document.getElementById("status");
+
+function connect() {
+    const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+    const ws = new WebSocket(scheme + "//" + location.host + "/increment/ws");
+    // Versions restart with the server, so only compare within a connection.
+    let version = -1;
+
+    ws.onopen = () => status.textContent = "connected";
+    ws.onmessage = (event) => {
+        const state = JSON.parse(event.data);
+        if (state.version > version) {
+            version = state.version;
+            value.textContent = state.value;
+        }
+    };
+    ws.onclose = () => {
+        status.textContent = "disconnected, reconnecting";
+        setTimeout(connect, 2000);
+    };
+}
+
+// The CSRF middleware hands out the token in a cookie and expects it back
+// in a header on POST.
+function csrfToken() {
+    const match = document.cookie.match(/(?:^|; )csrf_token=([^;]*)/);
+    return match ? decodeURIComponent(match[1]) : "";
+}
+
+document.getElementById("increment").onclick = () =>
+    fetch("/increment", { method: "POST", headers: { "X-CSRF-Token": csrfToken() } });
+
+connect();
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// embeddedTemplates is the copy of templates/ compiled into the binary, used
+// unless the config points at a directory on disk.
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// templateConfig selects where page templates come from. The directory
+// holds layouts/*.html (one of them defining "base"), partials/*.html and
+// pages/*.html; every page is rendered through the "base" layout with the
+// layouts and partials available to it.
+type templateConfig struct {
+	// Dir loads the templates from disk instead of the embedded copy.
+	Dir string `json:"dir,omitempty"`
+	// Dev re-parses the templates whenever a file changes and makes open
+	// pages reload themselves. Dir defaults to "templates" in dev mode.
+	Dev bool `json:"dev,omitempty"`
+}
+
+// templateSet holds the parsed pages of a templateConfig.
+type templateSet struct {
+	fsys fs.FS
+	dev  bool
+
+	mu      sync.Mutex
+	pages   map[string]*template.Template
+	version string
+}
+
+// pageData is what page templates render.
+type pageData struct {
+	Path     string
+	Counters map[string]int
+	Session  *session
+	Dev      bool
+	Now      time.Time
+}
+
+var templateFuncs = template.FuncMap{
+	// counter returns the current value of a global counter.
+	"counter": func(name string) int {
+		return counterValues()[name]
+	},
+}
+
+func newTemplateSet(cfg *templateConfig) (*templateSet, error) {
+	if cfg == nil {
+		cfg = &templateConfig{}
+	}
+	t := &templateSet{dev: cfg.Dev}
+	dir := cfg.Dir
+	if dir == "" && cfg.Dev {
+		dir = "templates"
+	}
+	if dir != "" {
+		t.fsys = os.DirFS(dir)
+	} else {
+		sub, err := fs.Sub(embeddedTemplates, "templates")
+		if err != nil {
+			return nil, err
+		}
+		t.fsys = sub
+	}
+
+	pages, err := t.parse()
+	if err != nil {
+		return nil, err
+	}
+	t.pages = pages
+	if t.dev {
+		t.version = t.stamp()
+	}
+	return t, nil
+}
+
+// parse builds every page as a clone of the layouts and partials plus the
+// page's own file, so pages can each define "title" and "content".
+func (t *templateSet) parse() (map[string]*template.Template, error) {
+	var shared []string
+	for _, pattern := range []string{"layouts/*.html", "partials/*.html"} {
+		files, err := fs.Glob(t.fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		shared = append(shared, files...)
+	}
+	if len(shared) == 0 {
+		return nil, errors.New("templates: no layouts found")
+	}
+	base, err := template.New("").Funcs(templateFuncs).ParseFS(t.fsys, shared...)
+	if err != nil {
+		return nil, fmt.Errorf("templates: %w", err)
+	}
+	if base.Lookup("base") == nil {
+		return nil, errors.New(`templates: no layout defines "base"`)
+	}
+
+	files, err := fs.Glob(t.fsys, "pages/*.html")
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string]*template.Template, len(files))
+	for _, file := range files {
+		page, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := page.ParseFS(t.fsys, file); err != nil {
+			return nil, fmt.Errorf("templates: %w", err)
+		}
+		pages[path.Base(file)] = page
+	}
+	return pages, nil
+}
+
+// stamp summarizes the modification times of all template files; it
+// changes when a file is edited, added or removed.
+func (t *templateSet) stamp() string {
+	var newest time.Time
+	n := 0
+	fs.WalkDir(t.fsys, ".", func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			n++
+			if fi.ModTime().After(newest) {
+				newest = fi.ModTime()
+			}
+		}
+		return nil
+	})
+	return fmt.Sprintf("%d-%d", newest.UnixNano(), n)
+}
+
+// lookup returns the named page, re-parsing first in dev mode if the files
+// changed.
+func (t *templateSet) lookup(name string) (*template.Template, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dev {
+		if version := t.stamp(); version != t.version {
+			pages, err := t.parse()
+			if err != nil {
+				return nil, err
+			}
+			t.pages, t.version = pages, version
+		}
+	}
+	page, ok := t.pages[name]
+	if !ok {
+		return nil, fmt.Errorf("templates: no page %q", name)
+	}
+	return page, nil
+}
+
+// page serves the named file of pages/.
+func (t *templateSet) page(name string) (http.Handler, error) {
+	if _, err := t.lookup(name); err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.render(w, r, name)
+	}), nil
+}
+
+func (t *templateSet) render(w http.ResponseWriter, r *http.Request, name string) {
+	data := pageData{
+		Path:     r.URL.Path,
+		Counters: counterValues(),
+		Session:  sessionFrom(r.Context()),
+		Dev:      t.dev,
+		Now:      time.Now(),
+	}
+	// Render into a buffer so a failing template becomes a clean 500
+	// instead of half a page.
+	var buf bytes.Buffer
+	page, err := t.lookup(name)
+	if err == nil {
+		err = page.ExecuteTemplate(&buf, "base", data)
+	}
+	if err != nil {
+		log.Printf("render %s: %v", name, err)
+		msg := http.StatusText(http.StatusInternalServerError)
+		if t.dev {
+			msg = err.Error()
+		}
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Pages show live data; let caches store them but always revalidate.
+	w.Header().Set("Cache-Control", "no-cache")
+	buf.WriteTo(w)
+}
+
+const liveReloadScript = `new EventSource("/_dev/reload").onmessage = () => location.reload();
+`
+
+// liveReload serves the dev mode reload script and the event stream it
+// listens to, which sends one event as soon as a template changes.
+func (t *templateSet) liveReload() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_dev/reload.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript")
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, liveReloadScript)
+	})
+	mux.HandleFunc("GET /_dev/reload", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		rc := http.NewResponseController(w)
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		start := t.stamp()
+		tick := time.NewTicker(500 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-tick.C:
+				if t.stamp() != start {
+					fmt.Fprint(w, "data: reload\n\n")
+					rc.Flush()
+					return
+				}
+			}
+		}
+	})
+	return mux
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedTemplates(t *testing.T) {
+	templates, err := newTemplateSet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := templates.page("index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	counters["counter"] = &counterState{Name: "counter", Value: 42}
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		delete(counters, "counter")
+		mutex.Unlock()
+	}()
+
+	rec := httptest.NewRecorder()
+	page.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	body := rec.Body.String()
+	if rec.Code != 200 || !strings.Contains(body, `<strong id="counter">42</strong>`) {
+		t.Errorf("expected the counter value in the page, got %d %q", rec.Code, body)
+	}
+	// Layout and partials are applied.
+	for _, want := range []string{"<title>Hello World</title>", "<nav>", "<footer>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page lacks %q", want)
+		}
+	}
+	if strings.Contains(body, "/_dev/reload.js") {
+		t.Error("live reload script outside dev mode")
+	}
+
+	if _, err := templates.page("missing.html"); err == nil {
+		t.Error("expected an error for an unknown page")
+	}
+}
+
+func writeTemplates(t *testing.T, dir string, files map[string]string, mtime time.Time) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+}
+
+func TestDevTemplatesReload(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Now().Add(-time.Hour)
+	writeTemplates(t, dir, map[string]string{
+		"layouts/base.html": `{{define "base"}}{{if .Dev}}[dev]{{end}}{{template "content" .}}{{end}}`,
+		"pages/page.html":   `{{define "content"}}v1{{end}}`,
+	}, mtime)
+
+	templates, err := newTemplateSet(&templateConfig{Dir: dir, Dev: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := templates.page("page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() (int, string) {
+		rec := httptest.NewRecorder()
+		page.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if _, body := get(); body != "[dev]v1" {
+		t.Errorf("expected [dev]v1, got %q", body)
+	}
+	writeTemplates(t, dir, map[string]string{"pages/page.html": `{{define "content"}}v2{{end}}`}, mtime.Add(time.Minute))
+	if _, body := get(); body != "[dev]v2" {
+		t.Errorf("edit not picked up: %q", body)
+	}
+	// A broken template shows the error instead of the page.
+	writeTemplates(t, dir, map[string]string{"pages/page.html": `{{define "content"}}{{end`}, mtime.Add(2*time.Minute))
+	if code, body := get(); code != 500 || !strings.Contains(body, "page.html") {
+		t.Errorf("expected the parse error, got %d %q", code, body)
+	}
+}
+
+func TestTemplateConfigErrors(t *testing.T) {
+	var tests = []struct {
+		name  string
+		files map[string]string
+	}{
+		{"no layouts", map[string]string{"pages/page.html": `x`}},
+		{"no base", map[string]string{"layouts/other.html": `{{define "other"}}{{end}}`}},
+		{"syntax", map[string]string{"layouts/base.html": `{{define "base"}}{{if}}{{end}}`}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		writeTemplates(t, dir, test.files, time.Now())
+		if _, err := newTemplateSet(&templateConfig{Dir: dir}); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexandreafj/golang-study/accesslog"
+)
+
+// hostConfig describes one virtual host: the Host header / SNI names it
+// answers to, its own routes (and therefore its own static root) and an
+// optional access log and certificate.
+type hostConfig struct {
+	// Names are exact hostnames ("example.localhost") or wildcards
+	// ("*.example.localhost", matching any subdomain).
+	Names     []string      `json:"names"`
+	Routes    []routeConfig `json:"routes"`
+	AccessLog string        `json:"access_log,omitempty"`
+	// Cert and Key are served to TLS clients asking for one of Names via
+	// SNI. Hosts without them use the server's -cert/-key pair.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// virtualHost is a built hostConfig.
+type virtualHost struct {
+	handler http.Handler
+	cert    *tls.Certificate
+}
+
+// hostDefaults are the config-wide settings every virtual host is built
+// with.
+type hostDefaults struct {
+	compressor *compressor
+	security   *securityHeaders
+	sessions   *sessionManager
+	templates  *templateSet
+	logFormat  accesslog.Format
+	logOptions accesslog.Options
+	metrics    *requestMetrics
+}
+
+// buildHost creates the mux for one host, registering its proxies in table
+// so they are stopped with it.
+func buildHost(h hostConfig, table *routeTable, defaults hostDefaults) (*virtualHost, error) {
+	if len(h.Routes) == 0 {
+		return nil, errors.New("no routes")
+	}
+	mux := http.NewServeMux()
+	for _, route := range h.Routes {
+		handler, err := route.handler(defaults)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", route.Path, err)
+		}
+		if lb, ok := handler.(*loadBalancer); ok {
+			table.proxies = append(table.proxies, lb)
+		}
+		mux.Handle(route.Path, handler)
+	}
+	if defaults.templates.dev {
+		mux.Handle("/_dev/", defaults.templates.liveReload())
+	}
+
+	vh := &virtualHost{handler: defaults.security.wrap(defaults.compressor.wrap(defaults.sessions.middleware(notePattern(mux))))}
+	if h.AccessLog != "" {
+		w, opened, err := openAccessLog(h.AccessLog, defaults.logOptions)
+		if err != nil {
+			return nil, err
+		}
+		if opened {
+			table.logs = append(table.logs, h.AccessLog)
+		}
+		vh.handler = accesslog.Middleware(w, defaults.logFormat, vh.handler)
+	}
+	if h.Cert != "" || h.Key != "" {
+		cert, err := tls.LoadX509KeyPair(h.Cert, h.Key)
+		if err != nil {
+			return nil, err
+		}
+		vh.cert = &cert
+	}
+	return vh, nil
+}
+
+// lookup finds the virtual host for a Host header or SNI name: an exact
+// match first, then the closest wildcard, then the default host (which may
+// be nil).
+func (t *routeTable) lookup(host string) *virtualHost {
+	host = normalizeHost(host)
+	if vh, ok := t.hosts[host]; ok {
+		return vh
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if vh, ok := t.hosts["*."+host]; ok {
+			return vh
+		}
+	}
+	return t.fallback
+}
+
+func (t *routeTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vh := t.lookup(r.Host)
+	if vh == nil {
+		http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+		return
+	}
+	vh.handler.ServeHTTP(w, r)
+}
+
+// normalizeHost strips the port and trailing dot from a Host header and
+// lowercases it.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// getCertificate picks the certificate for the SNI name of the current
+// route table, returning nil (use the default -cert/-key pair) when the
+// host has none.
+func (rt *router) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if vh := rt.table.Load().lookup(hello.ServerName); vh != nil && vh.cert != nil {
+		return vh.cert, nil
+	}
+	return nil, nil
+}
+
+// accessLogConfig sets the format and rotation of every access log of a
+// config.
+type accessLogConfig struct {
+	// Format is "combined" (the default) or "json".
+	Format      string   `json:"format,omitempty"`
+	MaxSizeMB   int64    `json:"max_size_mb,omitempty"`
+	RotateEvery duration `json:"rotate_every,omitempty"`
+	Compress    bool     `json:"compress,omitempty"`
+	MaxBackups  int      `json:"max_backups,omitempty"`
+	MaxAge      duration `json:"max_age,omitempty"`
+}
+
+func (c accessLogConfig) options() accesslog.Options {
+	return accesslog.Options{
+		MaxSize:     c.MaxSizeMB << 20,
+		RotateEvery: time.Duration(c.RotateEvery),
+		Compress:    c.Compress,
+		MaxBackups:  c.MaxBackups,
+		MaxAge:      time.Duration(c.MaxAge),
+	}
+}
+
+// accessLogs keeps access log writers open across config reloads, keyed by
+// path, so in-flight requests of a previous route table never write to a
+// closed file. A reload only updates their rotation settings.
+var accessLogs = struct {
+	sync.Mutex
+	writers map[string]*accesslog.Writer
+}{writers: map[string]*accesslog.Writer{}}
+
+// openAccessLog returns the writer of path, opening it unless it already
+// is open. opened reports whether it was.
+func openAccessLog(path string, opts accesslog.Options) (w *accesslog.Writer, opened bool, err error) {
+	accessLogs.Lock()
+	defer accessLogs.Unlock()
+	if w, ok := accessLogs.writers[path]; ok {
+		w.SetOptions(opts)
+		return w, false, nil
+	}
+	if w, err = accesslog.Open(path, opts); err != nil {
+		return nil, false, err
+	}
+	accessLogs.writers[path] = w
+	return w, true, nil
+}
+
+// closeAccessLog closes the writer of path, for a route table that failed
+// to build.
+func closeAccessLog(path string) {
+	accessLogs.Lock()
+	defer accessLogs.Unlock()
+	if w, ok := accessLogs.writers[path]; ok {
+		w.Close()
+		delete(accessLogs.writers, path)
+	}
+}
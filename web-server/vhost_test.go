@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "api.access.log")
+	cfg := &config{
+		Routes: []routeConfig{{Path: "/", Respond: &cannedResponse{Body: "default"}}},
+		Hosts: []hostConfig{
+			{Names: []string{"api.localhost"}, AccessLog: logPath, Routes: []routeConfig{{Path: "/", Respond: &cannedResponse{Body: "api"}}}},
+			{Names: []string{"*.docs.localhost", "docs.localhost"}, Routes: []routeConfig{{Path: "/", Respond: &cannedResponse{Body: "docs"}}}},
+		},
+	}
+	table, err := cfg.build(newRequestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+
+	var tests = []struct {
+		host     string
+		expected string
+	}{
+		{"api.localhost", "api"},
+		{"API.localhost:8081", "api"},
+		{"docs.localhost", "docs"},
+		{"v2.docs.localhost", "docs"},
+		{"a.b.docs.localhost.", "docs"},
+		{"other.localhost", "default"},
+		{"127.0.0.1:8081", "default"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = test.host
+		rec := httptest.NewRecorder()
+		table.ServeHTTP(rec, req)
+		if rec.Body.String() != test.expected {
+			t.Errorf("Host %s: expected %q, got %q", test.host, test.expected, rec.Body.String())
+		}
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"GET / HTTP/1.1" 200 3`) {
+		t.Errorf("unexpected access log:\n%s", data)
+	}
+}
+
+func TestVirtualHostWithoutDefault(t *testing.T) {
+	cfg := &config{Hosts: []hostConfig{{Names: []string{"a.localhost"}, Routes: []routeConfig{{Path: "/", Respond: &cannedResponse{Body: "a"}}}}}}
+	table, err := cfg.build(newRequestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	table.ServeHTTP(rec, httptest.NewRequest("GET", "http://b.localhost/", nil))
+	if rec.Code != 421 {
+		t.Errorf("expected 421 for unknown host, got %d", rec.Code)
+	}
+
+	dup := &config{Hosts: []hostConfig{
+		{Names: []string{"a.localhost"}, Routes: []routeConfig{{Path: "/", Static: "."}}},
+		{Names: []string{"A.localhost"}, Routes: []routeConfig{{Path: "/", Static: "."}}},
+	}}
+	if _, err := dup.build(newRequestMetrics()); err == nil {
+		t.Error("expected an error for a duplicate host name")
+	}
+}
+
+func TestVirtualHostSNI(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := createCA(dir, "test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issueCert(dir, "api", ca, []string{"api.localhost"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{
+		Routes: []routeConfig{{Path: "/", Static: "."}},
+		Hosts: []hostConfig{{
+			Names:  []string{"api.localhost"},
+			Cert:   filepath.Join(dir, "api.crt"),
+			Key:    filepath.Join(dir, "api.key"),
+			Routes: []routeConfig{{Path: "/", Static: "."}},
+		}},
+	}
+	table, err := cfg.build(newRequestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &router{}
+	rt.swap(table)
+
+	cert, _ := rt.getCertificate(&tls.ClientHelloInfo{ServerName: "api.localhost"})
+	if cert == nil || cert.Leaf == nil || cert.Leaf.Subject.CommonName != "api.localhost" {
+		t.Errorf("expected the api.localhost certificate, got %v", cert)
+	}
+	if cert, _ := rt.getCertificate(&tls.ClientHelloInfo{ServerName: "other.localhost"}); cert != nil {
+		t.Error("expected the default certificate for an unknown name")
+	}
+}
+
+func TestVirtualHostStreaming(t *testing.T) {
+	// The upstream sends an event, then holds the response open. The
+	// event must get through the proxy, sessions, compression, the access
+	// log and the metrics while it does.
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: hello\n\n")
+		http.NewResponseController(w).Flush()
+		<-release
+	}))
+	defer upstream.Close()
+
+	cfg := &config{
+		Routes:    []routeConfig{{Path: "/", Proxy: &proxyConfig{Targets: []string{upstream.URL}}}},
+		AccessLog: filepath.Join(t.TempDir(), "access.log"),
+	}
+	metrics := newRequestMetrics()
+	table, err := cfg.build(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	srv := httptest.NewServer(metrics.middleware(table))
+	defer srv.Close()
+	// Let the upstream finish before the servers wait for it.
+	defer close(release)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	line := make(chan string, 1)
+	go func() {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body := io.Reader(resp.Body)
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				line <- err.Error()
+				return
+			}
+		}
+		s, _ := bufio.NewReader(body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if s != "data: hello\n" {
+			t.Errorf("expected the event, got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event was held back until the response ended")
+	}
+}
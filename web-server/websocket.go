@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsKeepalive times the keepalive of counter WebSockets: the server pings
+// every pingPeriod and drops clients that answered nothing for pongWait or
+// can't take a message within writeWait.
+type wsKeepalive struct {
+	writeWait  time.Duration
+	pongWait   time.Duration
+	pingPeriod time.Duration
+}
+
+var defaultKeepalive = wsKeepalive{
+	writeWait:  10 * time.Second,
+	pongWait:   60 * time.Second,
+	pingPeriod: 54 * time.Second,
+}
+
+// counterHub fans counter changes out to WebSocket subscribers.
+type counterHub struct {
+	mu     sync.Mutex
+	subs   map[*counterSubscriber]struct{}
+	closed bool
+}
+
+type counterSubscriber struct {
+	name string
+	// updates holds at most the newest unsent state: a slow client skips
+	// intermediate values instead of blocking the publisher or growing a
+	// queue.
+	updates chan counterState
+	// done is closed when the server shuts down.
+	done chan struct{}
+}
+
+// counterEvents carries the changes of the global counters.
+var counterEvents = newCounterHub()
+
+func newCounterHub() *counterHub {
+	return &counterHub{subs: make(map[*counterSubscriber]struct{})}
+}
+
+func (h *counterHub) subscribe(name string) *counterSubscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := &counterSubscriber{name: name, updates: make(chan counterState, 1), done: make(chan struct{})}
+	if h.closed {
+		close(s.done)
+	} else {
+		h.subs[s] = struct{}{}
+	}
+	return s
+}
+
+func (h *counterHub) unsubscribe(s *counterSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+// publish hands state to every subscriber of its counter without ever
+// blocking: an update still waiting to be sent is replaced.
+func (h *counterHub) publish(state counterState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if s.name != state.Name {
+			continue
+		}
+		select {
+		case <-s.updates:
+		default:
+		}
+		s.updates <- state
+	}
+}
+
+// close disconnects all subscribers. http.Server.Shutdown doesn't wait for
+// hijacked connections, so it is registered with RegisterOnShutdown.
+func (h *counterHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		close(s.done)
+		delete(h.subs, s)
+	}
+}
+
+// upgrader keeps gorilla's default origin check: only pages of this host
+// may subscribe.
+var upgrader = websocket.Upgrader{ReadBufferSize: 512, WriteBufferSize: 1024}
+
+// watchCounter streams the named counter over a WebSocket: its current
+// state right after connecting, then every change, as the same JSON the
+// counter route returns.
+func watchCounter(name string, keepalive wsKeepalive) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // Upgrade has already answered the request
+		}
+		defer conn.Close()
+		sub := counterEvents.subscribe(name)
+		defer counterEvents.unsubscribe(sub)
+
+		// Clients have nothing to say; reading only processes pongs and
+		// close frames and notices when the client is gone.
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(keepalive.pongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(keepalive.pongWait))
+		})
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		var sent uint64
+		send := func(state counterState) error {
+			// The state read on connect may already include an update
+			// that is also waiting in the channel.
+			if sent > 0 && state.Version <= sent {
+				return nil
+			}
+			sent = state.Version
+			conn.SetWriteDeadline(time.Now().Add(keepalive.writeWait))
+			return conn.WriteJSON(state)
+		}
+		if err := send(counterValue(name)); err != nil {
+			return
+		}
+
+		ping := time.NewTicker(keepalive.pingPeriod)
+		defer ping.Stop()
+		for {
+			select {
+			case state := <-sub.updates:
+				if err := send(state); err != nil {
+					return
+				}
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(keepalive.writeWait)); err != nil {
+					return
+				}
+			case <-sub.done:
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(keepalive.writeWait))
+				return
+			case <-gone:
+				return
+			}
+		}
+	}
+}
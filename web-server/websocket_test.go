@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialCounter(t *testing.T, srv *httptest.Server, path string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + path
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func readCounter(t *testing.T, conn *websocket.Conn) counterState {
+	var state counterState
+	if err := conn.ReadJSON(&state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestWatchCounter(t *testing.T) {
+	resetCounter(t, "ws-test")
+	// Through the whole middleware stack, which must let the handler
+	// hijack the connection.
+	cfg := &config{
+		Routes: []routeConfig{
+			{Path: "/increment", Counter: "ws-test"},
+			{Path: "GET /increment/ws", Watch: "ws-test"},
+		},
+		Security: &securityConfig{CSRF: csrfConfig{Disabled: true}},
+	}
+	metrics := newRequestMetrics()
+	table, err := cfg.build(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(metrics.middleware(table))
+	defer srv.Close()
+
+	a := dialCounter(t, srv, "/increment/ws")
+	defer a.Close()
+	b := dialCounter(t, srv, "/increment/ws")
+	defer b.Close()
+	for _, conn := range []*websocket.Conn{a, b} {
+		if state := readCounter(t, conn); state.Value != 0 || state.Version != 0 {
+			t.Errorf("expected the initial state, got %+v", state)
+		}
+	}
+
+	resp, err := http.Post(srv.URL+"/increment?by=3", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, conn := range []*websocket.Conn{a, b} {
+		if state := readCounter(t, conn); state.Name != "ws-test" || state.Value != 3 || state.Version != 1 {
+			t.Errorf("expected value 3 version 1, got %+v", state)
+		}
+	}
+}
+
+func TestCounterHubBackpressure(t *testing.T) {
+	hub := newCounterHub()
+	sub := hub.subscribe("c")
+	other := hub.subscribe("other")
+
+	// A subscriber that doesn't read never blocks the publisher and only
+	// gets the newest state.
+	for i := 1; i <= 100; i++ {
+		hub.publish(counterState{Name: "c", Value: i, Version: uint64(i)})
+	}
+	if state := <-sub.updates; state.Version != 100 {
+		t.Errorf("expected the newest state, got %+v", state)
+	}
+	select {
+	case state := <-sub.updates:
+		t.Errorf("unexpected extra update %+v", state)
+	case state := <-other.updates:
+		t.Errorf("update of another counter delivered: %+v", state)
+	default:
+	}
+
+	hub.close()
+	for _, s := range []*counterSubscriber{sub, other, hub.subscribe("late")} {
+		select {
+		case <-s.done:
+		default:
+			t.Error("subscriber not closed")
+		}
+	}
+}
+
+func TestWatchCounterKeepalive(t *testing.T) {
+	keepalive := wsKeepalive{writeWait: time.Second, pongWait: 100 * time.Millisecond, pingPeriod: 20 * time.Millisecond}
+	srv := httptest.NewServer(watchCounter("ws-keepalive", keepalive))
+	defer srv.Close()
+	conn := dialCounter(t, srv, "/")
+	defer conn.Close()
+
+	pings := make(chan struct{}, 10)
+	conn.SetPingHandler(func(string) error {
+		pings <- struct{}{}
+		return conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(time.Second))
+	})
+	readCounter(t, conn)
+	go conn.ReadMessage()
+
+	// Answering pings keeps the connection open well past pongWait.
+	for i := 0; i < 8; i++ {
+		select {
+		case <-pings:
+		case <-time.After(time.Second):
+			t.Fatalf("ping %d not received", i)
+		}
+	}
+}